@@ -6,7 +6,9 @@ import (
 	s "strings"
 
 	"github.com/jeff-blank/mapper/pkg/config"
-	_ "github.com/lib/pq"
+	"github.com/jeff-blank/mapper/pkg/database"
+	_ "github.com/jeff-blank/mapper/pkg/database/drivers"
+	"github.com/jeff-blank/mapper/pkg/query"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,9 +21,20 @@ const (
 			counties_master cm,
 			counties_graph cg
 		where
-			cm_in.id = $1 and
+			cm_in.id = :county and
 			((cg.a=cm_in.id and cg.b=cm.id)
 			 or (cg.b=cm_in.id and cg.a=cm.id))`
+
+	COUNTIES_SQL = `select distinct
+	cm.id
+from
+	hits h,
+	bills b,
+	counties_master cm
+where
+	(h.country='US' and
+	h.bill_id = b.id and
+	h.county_id = cm.id)`
 )
 
 type Residence map[string]int
@@ -38,15 +51,31 @@ func findFreeGlobId(min, max int, ids map[int]int) int {
 	return -1
 }
 
-func dbConnect(dbconfig map[string]string) *sql.DB {
-	dbh, err := sql.Open(dbconfig["type"],
-		dbconfig["type"]+"://"+dbconfig["username"]+":"+
-			dbconfig["password"]+"@"+dbconfig["host"]+"/"+
-			dbconfig["name"]+dbconfig["connect_opts"])
+func dbConnect(dbconfig map[string]string) (*sql.DB, query.Style) {
+	dbh, style, err := database.Open(dbconfig)
 	if err != nil {
-		log.Fatal("sql.Open(): ", err)
+		log.Fatal("dbConnect(): ", err)
+	}
+	return dbh, style
+}
+
+// prepare a statement with :name parameters; its values are given to
+// stmtArgs() in a map, by name
+func dbPrepare(dbh *sql.DB, style query.Style, statement string) (*sql.Stmt, []string, error) {
+	positional, names, err := query.Positional(statement, style)
+	if err != nil {
+		return nil, nil, err
+	}
+	stmt, err := dbh.Prepare(positional)
+	return stmt, names, err
+}
+
+func stmtArgs(names []string, values map[string]any) []any {
+	args := make([]any, len(names))
+	for i, name := range names {
+		args[i] = values[name]
 	}
-	return dbh
+	return args
 }
 
 func getResidences(dbh *sql.DB) Residence {
@@ -71,22 +100,20 @@ func getResidences(dbh *sql.DB) Residence {
 	return results
 }
 
-// suck in count data
-func dbData(dbh *sql.DB, queryExtra string) CountyList {
+// suck in count data, for one residence or (for "_all") every one
+func dbData(dbh *sql.DB, style query.Style, residence string) CountyList {
 
 	results := make(CountyList)
 
-	query := `select distinct
-	cm.id
-from
-	hits h,
-	bills b,
-	counties_master cm
-where
-	(h.country='US' and
-	h.bill_id = b.id and
-	h.county_id = cm.id)` + queryExtra
-	rows, err := dbh.Query(query)
+	statement := COUNTIES_SQL
+	if residence != "_all" {
+		statement += ` and b.residence = :residence`
+	}
+	statement, args, err := query.Bind(statement, query.Params{"residence": residence}, style)
+	if err != nil {
+		log.Fatal("dbData(): ", err)
+	}
+	rows, err := dbh.Query(statement, args...)
 	if err != nil {
 		log.Fatal("dbData(): dbh.Query(): ", err)
 	}
@@ -106,12 +133,12 @@ where
 	return results
 }
 
-func findGlob(query *sql.Stmt, cid int, counties map[int]int, glob Glob) {
+func findGlob(adjacent *sql.Stmt, cid int, counties map[int]int, glob Glob) {
 	log.Debugf("getting glob for %#v\n", cid)
 
-	rows, err := query.Query(cid)
+	rows, err := adjacent.Query(cid)
 	if err != nil {
-		log.Fatal("findGlob(): query.Query(): ", err)
+		log.Fatal("findGlob(): adjacent.Query(): ", err)
 	}
 	defer rows.Close()
 
@@ -129,7 +156,7 @@ func findGlob(query *sql.Stmt, cid int, counties map[int]int, glob Glob) {
 		log.Debugf("%#v -> %#v", cid, adjCounty)
 		if _, found := counties[adjCounty]; found {
 			log.Debugf("%v: hit found in %v, moving latter to glob", cid, adjCounty)
-			findGlob(query, id, counties, glob)
+			findGlob(adjacent, id, counties, glob)
 			delete(counties, adjCounty)
 			glob[adjCounty] = 1
 		}
@@ -139,26 +166,33 @@ func findGlob(query *sql.Stmt, cid int, counties map[int]int, glob Glob) {
 	}
 }
 
-func dbAddGlobs(dbh *sql.DB, karta Karta, residence, dbAction string, cfg *config.Config) {
+func dbAddGlobs(dbh *sql.DB, style query.Style, karta Karta, residence, dbAction string, cfg *config.Config) {
 	var (
 		err      error
 		globStmt *sql.Stmt
+		names    []string
 	)
 
 	if dbAction == "insert" {
-		globStmt, err = dbh.Prepare(`insert into county_globs (county_id, glob_id) values ($1, $2)`)
+		globStmt, names, err = dbPrepare(dbh, style, `insert into county_globs (county_id, glob_id) values (:county, :glob)`)
 	} else if dbAction == "update" {
-		globStmt, err = dbh.Prepare(`update county_globs set ` + residence + `_glob_id = $2 where county_id = $1`)
+		// the residence label is part of a column name, so it can't be a
+		// parameter
+		column, identErr := style.Ident(residence + "_glob_id")
+		if identErr != nil {
+			log.Fatalf("dbAddGlobs(): residence '%s': %v", residence, identErr)
+		}
+		globStmt, names, err = dbPrepare(dbh, style, `update county_globs set `+column+` = :glob where county_id = :county`)
 	} else {
 		log.Fatalf("dbAddGlobs(): invalid action '%s'", dbAction)
 	}
 	if err != nil {
-		log.Fatal("dbAddGlobs(): prepare globStmt (%s/%s): %v", residence, dbAction, err)
+		log.Fatalf("dbAddGlobs(): prepare globStmt (%s/%s): %v", residence, dbAction, err)
 	}
 	if dbAction == "insert" {
 		_, err = dbh.Exec(`delete from county_globs`)
 		if err != nil {
-			log.Fatal("dbAddGlobs(): delete all from county_globs: %v", err)
+			log.Fatalf("dbAddGlobs(): delete all from county_globs: %v", err)
 		}
 	}
 	for gid, g := range karta {
@@ -166,7 +200,7 @@ func dbAddGlobs(dbh *sql.DB, karta Karta, residence, dbAction string, cfg *confi
 			gid = cfg.NoGlobIdDb
 		}
 		for cid, _ := range g {
-			res, err := globStmt.Exec(cid, gid)
+			res, err := globStmt.Exec(stmtArgs(names, map[string]any{"county": cid, "glob": gid})...)
 			if err != nil {
 				log.Fatalf("dbAddGlobs(): %s county %d with glob id %d: %v", dbAction, cid, gid, err)
 			}
@@ -196,24 +230,19 @@ func main() {
 
 	log.Debugf("%#v", cfg)
 
-	dbh := dbConnect(cfg.DbParam)
+	dbh, style := dbConnect(cfg.DbParam)
 	defer dbh.Close()
 
 	klumpKartaSamling := make(map[string]Karta, 0)
-	adjacencyQuery, err := dbh.Prepare(ADJACENCY_SQL)
+	adjacencyQuery, _, err := dbPrepare(dbh, style, ADJACENCY_SQL)
 	if err != nil {
 		log.Fatalf("prepare adjacencyQuery: %v", err)
 	}
 
 	residenceList := getResidences(dbh)
 	for residence, home := range residenceList {
-		var residenceWhere string
 		log.Debug("residence: ", residence)
-		if residence != "_all" {
-			residenceWhere = `and b.residence = '` + residence + `'`
-		}
-
-		countyList := dbData(dbh, residenceWhere)
+		countyList := dbData(dbh, style, residence)
 		log.Debugf("start: %d counties", len(countyList))
 		log.Debugf("%#v\n==========", len(countyList))
 
@@ -255,12 +284,12 @@ func main() {
 		klumpKartaSamling[s.ToLower(residence)] = klumpKarta
 	}
 
-	dbAddGlobs(dbh, klumpKartaSamling["_all"], "_all", "insert", cfg)
+	dbAddGlobs(dbh, style, klumpKartaSamling["_all"], "_all", "insert", cfg)
 	for residence, karta := range klumpKartaSamling {
 		if residence == "_all" {
 			continue
 		}
-		dbAddGlobs(dbh, karta, residence, "update", cfg)
+		dbAddGlobs(dbh, style, karta, residence, "update", cfg)
 	}
 
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	s "strings"
+	"unicode"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/render"
+	"github.com/jeff-blank/svgxml"
+	log "github.com/sirupsen/logrus"
+	"go.yaml.in/yaml/v4"
+)
+
+// the alias file for a map: its 'aliases', or else one next to its SVG and
+// named like it (e.g. usmap.aliases.yml for usmap.svg), if there is one.
+// "" for none, including when 'aliases' is "-".
+func aliasFile(attrs config.MapSet) string {
+	if attrs.Aliases == "-" {
+		return ""
+	} else if len(attrs.Aliases) > 0 {
+		return filepath.FromSlash(attrs.Aliases)
+	}
+	base := aliasBase(attrs.InputFile)
+	for _, ext := range []string{".yml", ".yaml", ".csv"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return ""
+}
+
+func aliasBase(infile string) string {
+	infile = filepath.FromSlash(infile)
+	return s.TrimSuffix(infile, filepath.Ext(infile)) + ".aliases"
+}
+
+// data key -> SVG path id, from a YAML mapping or from CSV rows of the two
+// (where lines starting with # are comments). Keys with an empty id are left
+// out.
+func loadAliases(file string) (map[string]string, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := make(map[string]string)
+	if s.ToLower(filepath.Ext(file)) == ".csv" {
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.Comment = '#'
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			if len(record) < 2 {
+				line, _ := reader.FieldPos(0)
+				return nil, fmt.Errorf("%s: line %d: need a data key and a path id", file, line)
+			}
+			aliases[s.TrimSpace(record[0])] = s.TrimSpace(record[1])
+		}
+	} else if err := yaml.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	for key, id := range aliases {
+		if len(id) == 0 || id == key {
+			delete(aliases, key)
+		}
+	}
+	return aliases, nil
+}
+
+// rename data keys to their SVG path ids; keys that become the same id are
+// added together
+func aliasData(data map[string]float64, aliases map[string]string) map[string]float64 {
+	if len(aliases) == 0 {
+		return data
+	}
+	out := make(map[string]float64, len(data))
+	for key, value := range data {
+		if id, ok := aliases[key]; ok {
+			key = id
+		}
+		out[key] += value
+	}
+	return out
+}
+
+// for each SVG, find the data keys that match none of its shapes, even with
+// its aliases, and write a starter alias file suggesting the most alike
+// shape without data for each. The file is named for the SVG, e.g.
+// usmap.aliases.suggested.yml, so it isn't used until it's been checked and
+// renamed.
+func suggestAliases(cfg *config.Config) error {
+	global, err := globalData(cfg)
+	if err != nil {
+		return err
+	}
+
+	type svgKeys struct {
+		aliasFile string
+		keys      map[string]bool
+		parents   map[string]string
+	}
+	svgs := make(map[string]*svgKeys)
+	var infiles []string
+	for _, maptype := range slices.Sorted(maps.Keys(cfg.Maps)) {
+		for _, attrs := range cfg.Maps[maptype] {
+			parents, mapdata, err := mapData(cfg, maptype, attrs, global)
+			if err != nil {
+				return fmt.Errorf("%s: %v", attrs.OutputFile, err)
+			}
+			infile := filepath.FromSlash(attrs.InputFile)
+			if cfg.MapLevel(maptype, attrs) > 0 {
+				mapsvg, err := svgxml.NewFromFile(infile)
+				if err != nil {
+					return fmt.Errorf("%s || can't create SVG object from %s", err.Error(), infile)
+				}
+				mapdata = pruneRegions(mapsvg, mapdata, parents)
+			}
+
+			keys, ok := svgs[infile]
+			if !ok {
+				keys = &svgKeys{aliasFile(attrs), make(map[string]bool), make(map[string]string)}
+				svgs[infile] = keys
+				infiles = append(infiles, infile)
+			}
+			for id := range mapdata {
+				keys.keys[id] = true
+				if parent, ok := parents[id]; ok {
+					keys.parents[id] = parent
+				}
+			}
+		}
+	}
+
+	for _, infile := range infiles {
+		keys := svgs[infile]
+		m, err := render.Load(config.MapSet{InputFile: infile}, cfg.LADefaults)
+		if err != nil {
+			return err
+		}
+		ids, err := m.Regions()
+		if err != nil {
+			return err
+		}
+		aliases, err := loadAliases(keys.aliasFile)
+		if err != nil {
+			return err
+		}
+
+		shapes := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			shapes[id] = true
+		}
+		used := make(map[string]bool)
+		var unmatched []string
+		for _, key := range slices.Sorted(maps.Keys(keys.keys)) {
+			id := key
+			if alias, ok := aliases[key]; ok {
+				id = alias
+			}
+			if shapes[id] {
+				used[id] = true
+			} else {
+				unmatched = append(unmatched, key)
+			}
+		}
+		if len(unmatched) == 0 {
+			log.Infof("%s: every data key matches a shape", infile)
+			continue
+		}
+		var unused []string
+		for _, id := range ids {
+			if !used[id] {
+				unused = append(unused, id)
+				used[id] = true
+			}
+		}
+
+		var out bytes.Buffer
+		fmt.Fprintf(&out, "# aliases for %s (data key: SVG path id), written by\n", filepath.Base(infile))
+		fmt.Fprintf(&out, "# 'mapper suggest-aliases'. Check each suggestion, then rename this file\n")
+		fmt.Fprintf(&out, "# to %s.\n", filepath.Base(aliasBase(infile))+".yml")
+		if len(aliases) > 0 {
+			// those that still work
+			fmt.Fprintf(&out, "\n# from %s\n", keys.aliasFile)
+			for _, key := range slices.Sorted(maps.Keys(aliases)) {
+				if !slices.Contains(unmatched, key) {
+					fmt.Fprintf(&out, "%s: %s\n", strconv.Quote(key), strconv.Quote(aliases[key]))
+				}
+			}
+		}
+		fmt.Fprintf(&out, "\n# not found in the SVG; \"\" where nothing looks like a match\n")
+		for _, key := range unmatched {
+			id, score := closestShape(key, keys.parents[key], unused)
+			if score < 0.5 {
+				fmt.Fprintf(&out, "%s: \"\"\n", strconv.Quote(key))
+				continue
+			}
+			fmt.Fprintf(&out, "%s: %s  # %.0f%% alike\n", strconv.Quote(key), strconv.Quote(id), score*100)
+		}
+		fmt.Fprintf(&out, "\n# shapes with no data:\n")
+		for _, id := range unused {
+			fmt.Fprintf(&out, "#   %s\n", id)
+		}
+
+		file := aliasBase(infile) + ".suggested.yml"
+		if err := os.WriteFile(file, out.Bytes(), 0644); err != nil {
+			return err
+		}
+		log.Infof("%s: %d data keys not found; suggestions in %s", infile, len(unmatched), file)
+	}
+	return nil
+}
+
+// the candidate shape most like a data key, and how alike they are (0 to 1).
+// When the key is named for its parent region (e.g. MN_Hennepin), only shapes
+// in the same parent are considered, and only the rest of the names compared.
+func closestShape(key, parent string, candidates []string) (string, float64) {
+	var (
+		best      string
+		bestScore float64
+	)
+	prefix := parent + "_"
+	inParent := len(parent) > 0 && s.HasPrefix(key, prefix)
+	for _, c := range candidates {
+		a, b := key, c
+		if inParent {
+			if !s.HasPrefix(c, prefix) {
+				continue
+			}
+			a, b = s.TrimPrefix(key, prefix), s.TrimPrefix(c, prefix)
+		}
+		if score := similarity(a, b); score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best, bestScore
+}
+
+// abbreviations that the two sides of a mismatch often disagree on
+var abbreviations = map[string]string{
+	"st":  "saint",
+	"ste": "sainte",
+	"mt":  "mount",
+	"ft":  "fort",
+	"pt":  "point",
+}
+
+// how alike two ids are, from 0 to 1, ignoring case, punctuation and
+// abbreviations
+func similarity(a, b string) float64 {
+	ra, rb := []rune(fuzzyKey(a)), []rune(fuzzyKey(b))
+	n := max(len(ra), len(rb))
+	if n == 0 {
+		return 0
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(n)
+}
+
+func fuzzyKey(id string) string {
+	words := s.FieldsFunc(s.ToLower(id), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		if full, ok := abbreviations[w]; ok {
+			words[i] = full
+		}
+	}
+	return s.Join(words, "")
+}
+
+// edit distance: the insertions, deletions and substitutions that turn a
+// into b
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	s "strings"
+	"time"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/database"
+	"github.com/jeff-blank/mapper/pkg/query"
+	log "github.com/sirupsen/logrus"
+)
+
+// render a map once per step between the first and last dates in the data,
+// each frame with everything up to the end of its step, and write the frames
+// as an animated GIF or PNG
+func animateMap(cfg *config.Config, maptype string, attrs config.MapSet) error {
+	anim := attrs.Animation
+	step := s.ToLower(anim.Step)
+
+	column, err := dbIdent(cfg.DbParam, anim.DateColumn)
+	if err != nil {
+		return fmt.Errorf("animation: %v", err)
+	}
+	params := queryParams(cfg, attrs)
+
+	var first, last time.Time
+	if len(anim.Start) == 0 || len(anim.End) == 0 {
+		min, max, err := dbDateRange(cfg.DbParam, column, params, query.Condition{SQL: attrs.DbWhere, Params: params})
+		if err != nil {
+			return err
+		}
+		first, last = min, max
+	}
+	if len(anim.Start) > 0 {
+		first, _ = time.Parse(time.DateOnly, anim.Start)
+	}
+	if len(anim.End) > 0 {
+		last, _ = time.Parse(time.DateOnly, anim.End)
+	}
+	if first.IsZero() || last.Before(first) {
+		return fmt.Errorf("animation: no dates to animate")
+	}
+
+	dateFormat := anim.DateFormat
+	if len(dateFormat) == 0 {
+		dateFormat = map[string]string{"year": "2006", "month": "2006-01"}[step]
+		if len(dateFormat) == 0 {
+			dateFormat = time.DateOnly
+		}
+	}
+	delay := anim.FrameDelay
+	if delay <= 0 {
+		delay = 250
+	}
+	hold := 2000
+	if anim.Hold != nil {
+		hold = *anim.Hold
+	}
+
+	var (
+		frames []*image.RGBA
+		delays []int
+	)
+	lines := attrs.LegendAnnotate.Annotation
+	for date := stepStart(first, step); !date.After(last); date = nextStep(date, step) {
+		frameAttrs := attrs
+		frameAttrs.LegendAnnotate.Annotation = make([]string, len(lines))
+		for i, line := range lines {
+			frameAttrs.LegendAnnotate.Annotation[i] = s.ReplaceAll(line, "%D%", date.Format(dateFormat))
+		}
+
+		// everything before the start of the next step
+		cond := query.Condition{
+			SQL:    column + " < :before",
+			Params: query.Params{"before": nextStep(date, step).Format(time.DateOnly)},
+		}
+		parents, mapdata, err := mapData(cfg, maptype, frameAttrs, nil, cond)
+		if err != nil {
+			return err
+		}
+		in, err := loadMapInputs(cfg, maptype, frameAttrs, parents, mapdata)
+		if err != nil {
+			return err
+		}
+		out, err := renderMap(cfg, maptype, frameAttrs, in, "png")
+		if err != nil {
+			return err
+		}
+		log.Debugf("%s: frame %s", attrs.OutputFile, date.Format(dateFormat))
+		frames = append(frames, out.img)
+		delays = append(delays, delay)
+	}
+	// hold the last frame so the final state can be seen
+	delays[len(delays)-1] += hold
+
+	outfile, err := os.Create(attrs.OutputFile)
+	if err != nil {
+		return err
+	}
+	if s.ToLower(filepath.Ext(attrs.OutputFile)) == ".gif" {
+		err = encodeGif(outfile, frames, delays)
+	} else {
+		err = encodeApng(outfile, frames, delays)
+	}
+	if err != nil {
+		outfile.Close()
+		return err
+	}
+	return outfile.Close()
+}
+
+// the earliest and latest values of a date column
+func dbDateRange(dbconfig map[string]string, column string, params query.Params, conditions ...query.Condition) (time.Time, time.Time, error) {
+	dbh, style, err := database.Open(dbconfig)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	defer dbh.Close()
+
+	stmt, args, err := dbSelect(dbconfig, params, []string{"min(" + column + ")", "max(" + column + ")"}, conditions...).
+		Build(style)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	log.Debugf("%s %v", stmt, args)
+
+	var min, max any
+	if err := dbh.QueryRow(stmt, args...).Scan(&min, &max); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("dbh.QueryRow(): %v", err)
+	}
+	first, err := dbDate(min)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	last, err := dbDate(max)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return first, last, nil
+}
+
+// drivers return dates as time.Time or as text
+func dbDate(v any) (time.Time, error) {
+	switch v := v.(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return v, nil
+	case []byte:
+		return dbDate(string(v))
+	case string:
+		for _, layout := range []string{time.DateOnly, time.DateTime, time.RFC3339, time.RFC3339Nano} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't use '%v' as a date", v)
+}
+
+// the first day of the step containing a date (weeks start on Monday)
+func stepStart(date time.Time, step string) time.Time {
+	y, m, d := date.Date()
+	switch step {
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case "week":
+		return time.Date(y, m, d-(int(date.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func nextStep(date time.Time, step string) time.Time {
+	switch step {
+	case "year":
+		return date.AddDate(1, 0, 0)
+	case "month":
+		return date.AddDate(0, 1, 0)
+	case "week":
+		return date.AddDate(0, 0, 7)
+	}
+	return date.AddDate(0, 0, 1)
+}
+
+// delays are in milliseconds
+func encodeGif(w io.Writer, frames []*image.RGBA, delays []int) error {
+	anim := &gif.GIF{}
+	for i, frame := range frames {
+		anim.Image = append(anim.Image, paletted(frame))
+		// GIF delays are 16 bits, in hundredths of a second
+		anim.Delay = append(anim.Delay, min((delays[i]+5)/10, math.MaxUint16))
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// reduce an image to its 256 most common colours; maps are mostly flat
+// fills, so the rest (antialiased edges and text) can take the nearest one
+func paletted(img *image.RGBA) *image.Paletted {
+	counts := make(map[color.RGBA]int)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			counts[img.RGBAAt(x, y)]++
+		}
+	}
+	colours := make([]color.RGBA, 0, len(counts))
+	for c := range counts {
+		colours = append(colours, c)
+	}
+	slices.SortFunc(colours, func(a, b color.RGBA) int {
+		return counts[b] - counts[a]
+	})
+	if len(colours) > 256 {
+		colours = colours[:256]
+	}
+
+	pal := make(color.Palette, len(colours))
+	index := make(map[color.RGBA]uint8)
+	for i, c := range colours {
+		pal[i] = c
+		index[c] = uint8(i)
+	}
+
+	out := image.NewPaletted(b, pal)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			i, ok := index[c]
+			if !ok {
+				i = uint8(pal.Index(c))
+				index[c] = i
+			}
+			out.SetColorIndex(x, y, i)
+		}
+	}
+	return out
+}
+
+// APNG: each frame is encoded as a PNG, and its image data is re-chunked
+// behind a frame control chunk; the first frame doubles as the still image
+// for viewers that don't animate. Delays are in milliseconds.
+func encodeApng(w io.Writer, frames []*image.RGBA, delays []int) error {
+	var out bytes.Buffer
+	out.WriteString("\x89PNG\r\n\x1a\n")
+
+	var ihdr []byte
+	seq := uint32(0)
+	for i, frame := range frames {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, frame); err != nil {
+			return err
+		}
+		chunks, err := pngChunks(buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		for _, c := range chunks {
+			switch c.kind {
+			case "IHDR":
+				if i == 0 {
+					ihdr = c.data
+					writeChunk(&out, "IHDR", ihdr)
+					writeChunk(&out, "acTL", be32(uint32(len(frames)), 0))
+				} else if !bytes.Equal(c.data, ihdr) {
+					return fmt.Errorf("apng: frame %d differs in size or colour type", i)
+				}
+
+				bounds := frame.Bounds()
+				fctl := be32(seq, uint32(bounds.Dx()), uint32(bounds.Dy()), 0, 0)
+				num, den := apngDelay(delays[i])
+				fctl = binary.BigEndian.AppendUint16(fctl, num)
+				fctl = binary.BigEndian.AppendUint16(fctl, den)
+				fctl = append(fctl, 0, 0) // dispose: none; blend: source
+				writeChunk(&out, "fcTL", fctl)
+				seq++
+			case "IDAT":
+				if i == 0 {
+					writeChunk(&out, "IDAT", c.data)
+				} else {
+					writeChunk(&out, "fdAT", append(be32(seq), c.data...))
+					seq++
+				}
+			}
+		}
+	}
+	writeChunk(&out, "IEND", nil)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// a delay in milliseconds as the numerator and denominator (of a second) of
+// an fcTL chunk, both 16 bits: in milliseconds if it fits, then hundredths,
+// then seconds, up to 65535 seconds
+func apngDelay(ms int) (uint16, uint16) {
+	ms = max(ms, 0)
+	for _, den := range []int{1000, 100, 1} {
+		if n := (ms*den + 500) / 1000; n <= math.MaxUint16 {
+			return uint16(n), uint16(den)
+		}
+	}
+	return math.MaxUint16, 1
+}
+
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+func pngChunks(p []byte) ([]pngChunk, error) {
+	var chunks []pngChunk
+	p = p[8:]
+	for len(p) >= 12 {
+		length := binary.BigEndian.Uint32(p)
+		if int(length) > len(p)-12 {
+			return nil, fmt.Errorf("apng: truncated chunk")
+		}
+		chunks = append(chunks, pngChunk{string(p[4:8]), p[8 : 8+length]})
+		p = p[12+length:]
+	}
+	return chunks, nil
+}
+
+func writeChunk(w *bytes.Buffer, kind string, data []byte) {
+	w.Write(be32(uint32(len(data))))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	w.WriteString(kind)
+	w.Write(data)
+	w.Write(be32(crc.Sum32()))
+}
+
+func be32(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// frame delays as an APNG's fcTL chunks give them, in milliseconds
+func apngDelays(t *testing.T, data []byte) []float64 {
+	t.Helper()
+	chunks, err := pngChunks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delays []float64
+	for _, c := range chunks {
+		if c.kind == "fcTL" {
+			num := binary.BigEndian.Uint16(c.data[20:])
+			den := binary.BigEndian.Uint16(c.data[22:])
+			delays = append(delays, float64(num)*1000/float64(den))
+		}
+	}
+	return delays
+}
+
+func TestApngLongDelays(t *testing.T) {
+	frames := []*image.RGBA{
+		image.NewRGBA(image.Rect(0, 0, 4, 4)),
+		image.NewRGBA(image.Rect(0, 0, 4, 4)),
+		image.NewRGBA(image.Rect(0, 0, 4, 4)),
+		image.NewRGBA(image.Rect(0, 0, 4, 4)),
+	}
+	// a frame, a hold of 70 s (too many milliseconds for 16 bits), one of
+	// 1000 s (too many hundredths) and one longer than fits at all
+	delays := []int{250, 250 + 70000, 1000000, 100000000}
+	want := []float64{250, 70250, 1000000, 65535000}
+
+	var buf bytes.Buffer
+	if err := encodeApng(&buf, frames, delays); err != nil {
+		t.Fatal(err)
+	}
+	got := apngDelays(t, buf.Bytes())
+	if len(got) != len(want) {
+		t.Fatalf("%d fcTL chunks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("frame %d: delay %v ms, want %v", i, got[i], want[i])
+		}
+	}
+}
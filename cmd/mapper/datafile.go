@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	s "strings"
+	"sync"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// merge per-map data file settings over the global 'data' section
+func dataFileParams(defaults, attrs config.DataFileParams) config.DataFileParams {
+	params := defaults
+
+	if len(attrs.DataFile) > 0 {
+		params.DataFile = attrs.DataFile
+	}
+	if len(attrs.DataFormat) > 0 {
+		params.DataFormat = attrs.DataFormat
+	}
+	if len(attrs.DataHeader) > 0 {
+		params.DataHeader = attrs.DataHeader
+	}
+	if len(attrs.DataDelimiter) > 0 {
+		params.DataDelimiter = attrs.DataDelimiter
+	}
+	if len(attrs.StateColumn) > 0 {
+		params.StateColumn = attrs.StateColumn
+	}
+	if len(attrs.CountyColumn) > 0 {
+		params.CountyColumn = attrs.CountyColumn
+	}
+	if len(attrs.TallyColumn) > 0 {
+		params.TallyColumn = attrs.TallyColumn
+	}
+
+	return params
+}
+
+// standard input can only be read once, but any number of maps may use it
+var readStdin = sync.OnceValues(func() ([]byte, error) {
+	return io.ReadAll(os.Stdin)
+})
+
+// suck in count data from a file (or standard input, if the file is "-")
+// instead of the database
+func fileData(params config.DataFileParams, levels []config.LevelParams) (*regionData, error) {
+	var (
+		data  *regionData
+		input io.Reader
+		err   error
+	)
+
+	format := s.ToLower(params.DataFormat)
+	if params.DataFile == "-" {
+		if len(format) == 0 {
+			return nil, fmt.Errorf("data_format is required when reading standard input")
+		}
+		stdin, err := readStdin()
+		if err != nil {
+			return nil, fmt.Errorf("read standard input: %v", err)
+		}
+		input = bytes.NewReader(stdin)
+	} else {
+		fh, err := os.Open(filepath.FromSlash(params.DataFile))
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		input = fh
+	}
+
+	if len(format) == 0 {
+		format = s.TrimPrefix(s.ToLower(filepath.Ext(params.DataFile)), ".")
+	}
+
+	switch format {
+	case "csv", "tsv", "txt":
+		data, err = csvData(input, format, params, levels)
+	case "json":
+		data, err = jsonData(input, params, levels)
+	case "ndjson", "jsonl":
+		data, err = ndjsonData(input, params, levels)
+	default:
+		return nil, fmt.Errorf("%s: unknown data_format '%s'", params.DataFile, format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", params.DataFile, err)
+	}
+
+	return data, nil
+}
+
+// the data file column (or JSON member) given for each level, as far down
+// as the data goes: data_state_column and data_county_column name the first
+// two levels' columns. An empty name means the level's data_column (or, in
+// a file without a header, its position); "-" ends the levels early, for
+// files without the deeper ones.
+func dataColumns(levels []config.LevelParams, params config.DataFileParams) []string {
+	var columns []string
+	for i := range levels {
+		var column string
+		switch i {
+		case 0:
+			column = params.StateColumn
+		case 1:
+			column = params.CountyColumn
+		}
+		if column == "-" {
+			break
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// the header of delimited text, given its first row and a data_header
+// setting: yes (the default), no, or auto, where the first row is a header if
+// none of its fields is a number
+func csvHeader(first []string, dataHeader, file string) ([]string, error) {
+	switch s.ToLower(dataHeader) {
+	case "", "yes", "true":
+		return first, nil
+	case "no", "false":
+		return nil, nil
+	case "auto":
+	default:
+		return nil, fmt.Errorf("invalid data_header '%s'", dataHeader)
+	}
+
+	// a data row always has a numeric tally; a header row has none
+	row := s.Join(first, ",")
+	for _, field := range first {
+		if _, err := strconv.ParseFloat(s.TrimSpace(field), 64); err == nil {
+			log.Debugf("%s: data_header auto: the first row (%s) is data", file, row)
+			return nil, nil
+		}
+	}
+	// but neither has a data row whose tally is blank
+	if slices.ContainsFunc(first, func(field string) bool { return len(s.TrimSpace(field)) == 0 }) {
+		log.Warnf("%s: data_header auto: the first row (%s) has a blank field, so it may be data, but it's taken as a header", file, row)
+	} else {
+		log.Debugf("%s: data_header auto: the first row (%s) is a header", file, row)
+	}
+	return first, nil
+}
+
+// read rows with a column per level and a tally from delimited text, rolling
+// them up the same way dbData() does
+func csvData(r io.Reader, format string, params config.DataFileParams, levels []config.LevelParams) (*regionData, error) {
+	delim, err := csvDelimiter(format, params.DataDelimiter)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comma = delim
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if delim == '\t' {
+		reader.LazyQuotes = true
+	}
+
+	first, err := reader.Read()
+	if err == io.EOF {
+		return newRegionData(len(levels)), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	header, err := csvHeader(first, params.DataHeader, params.DataFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var regionCols []int
+	for i, name := range dataColumns(levels, params) {
+		col, err := csvColumn(header, name, levels[i].DataColumn, i+1)
+		if err != nil {
+			return nil, err
+		}
+		regionCols = append(regionCols, col)
+	}
+	tallyCol, err := csvColumn(header, params.TallyColumn, "tally", len(levels)+1)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []dataRow
+	record := first
+	if header != nil {
+		record, err = reader.Read()
+	}
+	for ; err == nil; record, err = reader.Read() {
+		line, _ := reader.FieldPos(0)
+		for _, col := range append([]int{tallyCol}, regionCols...) {
+			if col >= len(record) {
+				return nil, fmt.Errorf("line %d: %d fields, need at least %d", line, len(record), col+1)
+			}
+		}
+
+		count, err := parseTally(record[tallyCol])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		row := dataRow{tally: count}
+		for _, col := range regionCols {
+			row.regions = append(row.regions, record[col])
+		}
+		if len(s.TrimSpace(row.regions[0])) == 0 {
+			return nil, fmt.Errorf("line %d: empty %s", line, levels[0].DataColumn)
+		}
+		rows = append(rows, row)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+
+	return rollup(levels, rows), nil
+}
+
+func csvDelimiter(format, delimiter string) (rune, error) {
+	switch delimiter {
+	case "":
+		if format == "tsv" {
+			return '\t', nil
+		}
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+
+	runes := []rune(delimiter)
+	if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+		return 0, fmt.Errorf("invalid data_delimiter '%s'", delimiter)
+	}
+	return runes[0], nil
+}
+
+// find a column by (case-insensitive) header name or by 1-based position
+func csvColumn(header []string, name, defaultName string, defaultPos int) (int, error) {
+	if len(name) == 0 {
+		if header == nil {
+			return defaultPos - 1, nil
+		}
+		name = defaultName
+	}
+
+	for i, h := range header {
+		if s.EqualFold(s.TrimSpace(h), name) {
+			return i, nil
+		}
+	}
+
+	pos, err := strconv.Atoi(name)
+	if err != nil || pos < 1 {
+		if header == nil {
+			return -1, fmt.Errorf("column '%s' given by name but the file has no header", name)
+		}
+		return -1, fmt.Errorf("column '%s' not found in header", name)
+	}
+	return pos - 1, nil
+}
+
+// read tallies from a JSON document, which is either an object or an array of
+// row objects (see jsonRow()). Object members are either "region": tally
+// pairs, used as-is for every level (as with inline_data), or nested
+// "state": {"county": tally, ...} objects, one level of nesting per level of
+// the hierarchy, which are rolled up like dbData() does.
+func jsonData(r io.Reader, params config.DataFileParams, levels []config.LevelParams) (*regionData, error) {
+	var rows []dataRow
+	pairs := make(map[string]float64)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return newRegionData(len(levels)), nil
+	} else if err != nil {
+		return nil, jsonError(data, dec, err)
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, jsonError(data, dec, err)
+			}
+			key := keyTok.(string)
+			line := jsonLine(data, dec.InputOffset())
+
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, jsonError(data, dec, err)
+			}
+
+			if len(value) > 0 && value[0] == '{' {
+				if err := jsonTree(value, []string{key}, len(levels), &rows); err != nil {
+					return nil, fmt.Errorf("line %d: %v", line, err)
+				}
+			} else {
+				count, err := parseTally(string(value))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: '%s': %v", line, key, err)
+				}
+				pairs[key] += count
+			}
+		}
+	case json.Delim('['):
+		for dec.More() {
+			line := jsonLine(data, dec.InputOffset())
+			var row map[string]any
+			if err := dec.Decode(&row); err != nil {
+				return nil, jsonError(data, dec, err)
+			}
+			dr, err := jsonRow(row, params, levels)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			rows = append(rows, dr)
+		}
+	default:
+		return nil, fmt.Errorf("line %d: expected an object or an array", jsonLine(data, dec.InputOffset()))
+	}
+
+	// closing delimiter, then nothing else
+	if _, err := dec.Token(); err != nil {
+		return nil, jsonError(data, dec, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("line %d: unexpected data after end of document", jsonLine(data, dec.InputOffset()))
+	}
+
+	regions := rollup(levels, rows)
+	flat := flatData(len(levels), pairs)
+	for i := range levels {
+		for id, count := range flat.tallies[i] {
+			regions.tallies[i][id] += count
+		}
+		for id, parent := range flat.parents[i] {
+			regions.parents[i][id] = parent
+		}
+	}
+	return regions, nil
+}
+
+// rows from a nested object: each member is a region one level further down,
+// and the innermost members are tallies
+func jsonTree(value json.RawMessage, path []string, levels int, rows *[]dataRow) error {
+	name := s.Join(path, "'/'")
+	if len(value) == 0 || value[0] != '{' {
+		count, err := parseTally(string(value))
+		if err != nil {
+			return fmt.Errorf("'%s': %v", name, err)
+		}
+		*rows = append(*rows, dataRow{regions: path, tally: count})
+		return nil
+	}
+
+	if len(path) >= levels {
+		return fmt.Errorf("'%s': nested deeper than the %d levels of regions", name, levels)
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(value, &members); err != nil {
+		return fmt.Errorf("'%s': %v", name, err)
+	}
+	for key, member := range members {
+		if err := jsonTree(member, append(slices.Clip(path), key), levels, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read tallies from newline-delimited JSON, one row object (see jsonRow()) per
+// line
+func ndjsonData(r io.Reader, params config.DataFileParams, levels []config.LevelParams) (*regionData, error) {
+	var rows []dataRow
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var row map[string]any
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.UseNumber()
+		if err := dec.Decode(&row); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("line %d: more than one value", line)
+		}
+		dr, err := jsonRow(row, params, levels)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rows = append(rows, dr)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %v", line+1, err)
+	}
+
+	return rollup(levels, rows), nil
+}
+
+// one {"state": "...", "county": "...", "tally": n} row. Key names come from
+// the levels and the data_*_column settings (see dataColumns()); deeper
+// levels may be omitted (or null) to give a tally for a bigger region, e.g. a
+// state-only tally.
+func jsonRow(row map[string]any, params config.DataFileParams, levels []config.LevelParams) (dataRow, error) {
+	if row == nil {
+		return dataRow{}, fmt.Errorf("expected an object")
+	}
+
+	tallyKey := params.TallyColumn
+	if len(tallyKey) == 0 {
+		tallyKey = "tally"
+	}
+
+	var dr dataRow
+	for i, key := range dataColumns(levels, params) {
+		if len(key) == 0 {
+			key = levels[i].DataColumn
+		}
+		region, err := jsonString(row, key)
+		if err != nil {
+			return dataRow{}, err
+		}
+		if len(region) == 0 {
+			if i == 0 {
+				return dataRow{}, fmt.Errorf("missing or empty '%s'", key)
+			}
+			break
+		}
+		dr.regions = append(dr.regions, region)
+	}
+
+	value, ok := jsonField(row, tallyKey)
+	if !ok {
+		return dataRow{}, fmt.Errorf("missing '%s'", tallyKey)
+	}
+	var err error
+	switch v := value.(type) {
+	case json.Number:
+		dr.tally, err = parseTally(string(v))
+	case string:
+		dr.tally, err = parseTally(v)
+	default:
+		err = fmt.Errorf("tally is not a number")
+	}
+	if err != nil {
+		return dataRow{}, err
+	}
+	return dr, nil
+}
+
+// find a row member by exact, then case-insensitive, name
+func jsonField(row map[string]any, key string) (any, bool) {
+	if v, ok := row[key]; ok {
+		return v, true
+	}
+	for k, v := range row {
+		if s.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func jsonString(row map[string]any, key string) (string, error) {
+	value, ok := jsonField(row, key)
+	if !ok || value == nil {
+		return "", nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("'%s' is not a string", key)
+	}
+	return s.TrimSpace(str), nil
+}
+
+// tallies may be whole numbers or decimals (rates, averages)
+func parseTally(str string) (float64, error) {
+	str = s.TrimSpace(str)
+	count, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(count) || math.IsInf(count, 0) {
+		return 0, fmt.Errorf("tally '%s' is not a number", str)
+	}
+	return count, nil
+}
+
+// line number of the first non-separator character at or after offset
+func jsonLine(data []byte, offset int64) int {
+	for offset < int64(len(data)) && s.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// attach a line number to a decoding error
+func jsonError(data []byte, dec *json.Decoder, err error) error {
+	offset := dec.InputOffset()
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("unexpected end of input")
+		offset = int64(len(data))
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return fmt.Errorf("line %d: %v", bytes.Count(data[:offset], []byte("\n"))+1, err)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"maps"
+	s "strings"
+	"testing"
+)
+
+func TestCsvHeader(t *testing.T) {
+	for _, tc := range []struct {
+		dataHeader string
+		first      string
+		header     bool
+	}{
+		{"", "state,count", true},
+		{"", "MN,12", true},
+		{"yes", "MN,12", true},
+		{"no", "state,count", false},
+		{"auto", "state,count", true},
+		{"auto", "MN,12", false},
+		{"auto", "fips,2023", false},
+		{"auto", "MN,", true},
+	} {
+		first := s.Split(tc.first, ",")
+		header, err := csvHeader(first, tc.dataHeader, "test.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (header != nil) != tc.header {
+			t.Errorf("data_header '%s': '%s' taken as a header: %v", tc.dataHeader, tc.first, header != nil)
+		}
+	}
+	if _, err := csvHeader([]string{"a"}, "maybe", "test.csv"); err == nil {
+		t.Error("no error for data_header 'maybe'")
+	}
+}
+
+// denominator files go by data_header like data files do
+func TestCsvDenominators(t *testing.T) {
+	for _, tc := range []struct {
+		dataHeader, csv string
+		want            map[string]float64
+	}{
+		{"", "state,pop\nMN,5.7\n", map[string]float64{"MN": 5.7}},
+		{"", "MN,5.7\nWI,5.9\n", map[string]float64{"WI": 5.9}},
+		{"auto", "MN,5.7\nWI,5.9\n", map[string]float64{"MN": 5.7, "WI": 5.9}},
+		{"no", "MN,5.7\nWI,5.9\n", map[string]float64{"MN": 5.7, "WI": 5.9}},
+	} {
+		got, err := csvDenominators(s.NewReader(tc.csv), "csv", "", tc.dataHeader, "pop.csv")
+		if err != nil {
+			t.Errorf("data_header '%s': %v", tc.dataHeader, err)
+		} else if !maps.Equal(got, tc.want) {
+			t.Errorf("data_header '%s': got %v, want %v", tc.dataHeader, got, tc.want)
+		}
+	}
+	if _, err := csvDenominators(s.NewReader("state,pop\nMN,5.7\n"), "csv", "", "no", "pop.csv"); err == nil {
+		t.Error("data_header 'no': no error for a header read as data")
+	}
+}
@@ -0,0 +1,139 @@
+//go:build cgo
+
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/database"
+)
+
+// a configuration using a SQLite database of events, with four in the US
+// and one in Canada
+func sqliteConfig(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	dbfile := filepath.Join(dir, "events.db")
+	dbh, _, err := database.Open(map[string]string{"type": "sqlite", "name": dbfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Close()
+	for _, stmt := range []string{
+		`create table events (country text, state text, county text, event_date text)`,
+		`insert into events values
+			('US', 'MN', 'Hennepin', '2024-01-10'),
+			('US', 'MN', 'Hennepin', '2024-03-05'),
+			('US', 'MN', 'Ramsey',   '2024-02-01'),
+			('US', 'WI', 'Dane',     '2024-02-20'),
+			('CA', 'ON', 'Ottawa',   '2023-12-31')`,
+		`create table population (state text, year integer, pop integer)`,
+		`insert into population values ('MN', 2020, 5700000), ('WI', 2020, 5900000), ('MN', 2010, 5300000)`,
+	} {
+		if _, err := dbh.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	yml := `params:
+  country: "US"
+database:
+  type:           "sqlite"
+  name:           "` + filepath.ToSlash(dbfile) + `"
+  state_column:   "state"
+  county_column:  "county"
+  tally_column:   "count(*)"
+  tables:         "events"
+  where:          "where country = :country"
+  group_by:       "group by state, county"
+`
+	cfgfile := filepath.Join(dir, "mapper.yml")
+	if err := os.WriteFile(cfgfile, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, problems, err := config.Load(cfgfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("mapper.yml:%s", p)
+	}
+	if len(problems) > 0 {
+		t.FailNow()
+	}
+	return cfg
+}
+
+func TestSqliteData(t *testing.T) {
+	cfg := sqliteConfig(t)
+	states := func(attrs config.MapSet) map[string]float64 {
+		t.Helper()
+		global, err := globalData(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := mapData(cfg, "states", attrs, global)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	for _, tc := range []struct {
+		name      string
+		overrides map[string]string
+		attrs     config.MapSet
+		want      map[string]float64
+	}{
+		{"global", nil, config.MapSet{}, map[string]float64{"MN": 3, "WI": 1}},
+		{"db_where", nil, config.MapSet{DbWhere: "state = :state", Params: map[string]string{"state": "WI"}}, map[string]float64{"WI": 1}},
+		{"map params", nil, config.MapSet{Params: map[string]string{"country": "CA"}}, map[string]float64{"ON": 1}},
+		{"-param", map[string]string{"country": "CA"}, config.MapSet{}, map[string]float64{"ON": 1}},
+		{"quoted value", map[string]string{"country": "US' or '1'='1"}, config.MapSet{}, map[string]float64{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.ParamOverrides = tc.overrides
+			if got := states(tc.attrs); !maps.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+	cfg.ParamOverrides = nil
+
+	since := config.MapSet{Delta: config.DeltaParams{Since: "2024-02-01", DateColumn: "event_date"}}
+	before, err := baselineData(cfg, "states", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"MN": 1}; !maps.Equal(before, want) {
+		t.Errorf("before %s: got %v, want %v", since.Delta.Since, before, want)
+	}
+
+	column, err := dbIdent(cfg.DbParam, "event_date")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, last, err := dbDateRange(cfg.DbParam, column, queryParams(cfg, config.MapSet{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC); !first.Equal(want) {
+		t.Errorf("first date %v, want %v", first, want)
+	}
+	if want := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC); !last.Equal(want) {
+		t.Errorf("last date %v, want %v", last, want)
+	}
+
+	pop, err := dbDenominators(cfg.DbParam, "select state, pop from population where year = :year", map[string]any{"year": 2020})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"MN": 5700000, "WI": 5900000}; !maps.Equal(pop, want) {
+		t.Errorf("denominators %v, want %v", pop, want)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	s "strings"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/query"
+	"github.com/jeff-blank/mapper/pkg/render"
+	log "github.com/sirupsen/logrus"
+)
+
+func deltaMode(attrs config.MapSet) bool {
+	return len(attrs.Delta.Baseline) > 0 || len(attrs.Delta.Since) > 0
+}
+
+// the tallies to compare a map's data with: a previous run's, saved in the
+// baseline file (or a snapshot), or the data from before the 'since' date. A
+// baseline file that doesn't exist yet gives nil, so there's nothing to
+// compare with.
+func baselineData(cfg *config.Config, maptype string, attrs config.MapSet) (map[string]float64, error) {
+	delta := attrs.Delta
+	if len(delta.Since) > 0 {
+		column, err := dbIdent(cfg.DbParam, delta.DateColumn)
+		if err != nil {
+			return nil, fmt.Errorf("delta: %v", err)
+		}
+		cond := query.Condition{SQL: column + " < :since", Params: query.Params{"since": delta.Since}}
+		_, data, err := mapData(cfg, maptype, attrs, nil, cond)
+		return data, err
+	}
+
+	baseline, err := os.ReadFile(delta.Baseline)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("%s: no baseline yet in '%s'", attrs.OutputFile, delta.Baseline)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// a snapshot from an earlier run will do as well
+	var snap snapshot
+	if err := json.Unmarshal(baseline, &snap); err == nil && snap.Version > 0 {
+		return snap.Data, nil
+	}
+	data := make(map[string]float64)
+	if err := json.Unmarshal(baseline, &data); err != nil {
+		return nil, fmt.Errorf("baseline '%s': %v", delta.Baseline, err)
+	}
+	return data, nil
+}
+
+// write a map's tallies for the next run to compare with
+func saveBaseline(file string, data map[string]float64) error {
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(out, '\n'), 0644)
+}
+
+// the regions that are coloured now but had no data in the baseline
+func newRegions(values map[string]float64, baseline map[string]float64, scale *render.Scale) []string {
+	var ids []string
+	for id, value := range values {
+		if _, ok := scale.Colour(value); ok && baseline[id] <= 0 {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// fill in %n% (the number of new regions) and %nt% (their tally) in
+// annotation lines
+func deltaAnnotation(lines []string, ids []string, data map[string]float64, decimals int) []string {
+	tally := 0.0
+	for _, id := range ids {
+		tally += data[id]
+	}
+	r := s.NewReplacer("%nt%", render.FormatNumber(tally, decimals), "%n%", strconv.Itoa(len(ids)))
+
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = r.Replace(line)
+	}
+	return out
+}
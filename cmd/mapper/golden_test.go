@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	s "strings"
+	"testing"
+	"time"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+const (
+	// how far apart a channel of a pixel can be before the pixel counts as
+	// different, and how many pixels (per 1000) can be different, to allow
+	// for font rendering and anti-aliasing that differ a little
+	pngChannelTolerance = 16
+	pngMaxDiffPerMille  = 5
+)
+
+// draw every map in testdata/mapper.yml the way main() does, and compare each
+// with its golden file: SVGs element by element, PNGs pixel by pixel within
+// a tolerance. 'go test -run Golden -update' rewrites the golden files.
+func TestGoldenMaps(t *testing.T) {
+	golden, err := filepath.Abs(filepath.Join("testdata", "golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := fixtureConfig(t)
+	global, err := globalData(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, maptype := range slices.Sorted(maps.Keys(cfg.Maps)) {
+		for _, attrs := range cfg.Maps[maptype] {
+			t.Run(attrs.Name, func(t *testing.T) {
+				if err := drawMap(context.Background(), cfg, maptype, attrs, global, started); err != nil {
+					t.Fatal(err)
+				}
+				got := filepath.FromSlash(attrs.OutputFile)
+				want := filepath.Join(golden, filepath.Base(got))
+				if *update {
+					if err := copyFile(got, want); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+
+				switch filepath.Ext(got) {
+				case ".svg":
+					compareSvg(t, got, want)
+				case ".png":
+					comparePng(t, got, want)
+				default:
+					t.Fatalf("no comparison for '%s'", got)
+				}
+			})
+		}
+	}
+}
+
+// testdata/mapper.yml, loaded in a temporary copy of testdata (with go.ttf
+// and an out directory), which is made the working directory
+func fixtureConfig(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	if err := copyFixtures("testdata", dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.ttf"), goregular.TTF, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	cfg, problems, err := config.Load("mapper.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("mapper.yml:%s", p)
+	}
+	if len(problems) > 0 {
+		t.FailNow()
+	}
+	return cfg
+}
+
+// the files (not directories) in one directory, copied to another
+func copyFixtures(from, to string) error {
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := copyFile(filepath.Join(from, e.Name()), filepath.Join(to, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(from, to string) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(to, data, 0644)
+}
+
+func compareSvg(t *testing.T, got, want string) {
+	t.Helper()
+	gotTree, err := svgTree(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTree, err := svgTree(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range max(len(gotTree), len(wantTree)) {
+		var g, w string
+		if i < len(gotTree) {
+			g = gotTree[i]
+		}
+		if i < len(wantTree) {
+			w = wantTree[i]
+		}
+		if g != w {
+			t.Fatalf("%s differs from %s at element %d:\n got: %s\nwant: %s", got, want, i, g, w)
+		}
+	}
+}
+
+// an SVG as one line per element (its depth, name and attributes, sorted)
+// and per piece of text, so that formatting, attribute order and namespace
+// prefixes don't matter
+func svgTree(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree []string
+	depth := 0
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			var attrs []string
+			for _, a := range token.Attr {
+				if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+					continue
+				}
+				attrs = append(attrs, fmt.Sprintf("%s=%q", a.Name.Local, a.Value))
+			}
+			slices.Sort(attrs)
+			tree = append(tree, fmt.Sprintf("%s<%s %s>", s.Repeat(" ", depth), token.Name.Local, s.Join(attrs, " ")))
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if text := s.TrimSpace(string(token)); len(text) > 0 {
+				tree = append(tree, fmt.Sprintf("%s%q", s.Repeat(" ", depth), text))
+			}
+		}
+	}
+	return tree, nil
+}
+
+func comparePng(t *testing.T, got, want string) {
+	t.Helper()
+	gotImg, err := readPng(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantImg, err := readPng(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotImg.Bounds() != wantImg.Bounds() {
+		t.Fatalf("%s is %v, but %s is %v", got, gotImg.Bounds(), want, wantImg.Bounds())
+	}
+
+	b := gotImg.Bounds()
+	diff := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !pixelsAlike(gotImg.At(x, y), wantImg.At(x, y)) {
+				diff++
+			}
+		}
+	}
+	if diff*1000 > b.Dx()*b.Dy()*pngMaxDiffPerMille {
+		t.Fatalf("%s: %d of %d pixels differ from %s", got, diff, b.Dx()*b.Dy(), want)
+	}
+}
+
+func pixelsAlike(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	for _, d := range [][2]uint32{{ar, br}, {ag, bg}, {ab, bb}, {aa, ba}} {
+		// 16-bit channels
+		if max(d[0], d[1])-min(d[0], d[1]) > pngChannelTolerance*0x101 {
+			return false
+		}
+	}
+	return true
+}
+
+func readPng(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return img, nil
+}
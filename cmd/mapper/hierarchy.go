@@ -0,0 +1,161 @@
+package main
+
+import (
+	s "strings"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/svgxml"
+)
+
+// the tallies at every level of the region hierarchy, coarsest first, and
+// the region each one is in at the level above
+type regionData struct {
+	tallies []map[string]float64
+	parents []map[string]string
+}
+
+func newRegionData(levels int) *regionData {
+	data := &regionData{
+		tallies: make([]map[string]float64, levels),
+		parents: make([]map[string]string, levels),
+	}
+	for i := range levels {
+		data.tallies[i] = make(map[string]float64)
+		data.parents[i] = make(map[string]string)
+	}
+	return data
+}
+
+// one row of data: its value at each level, as far down as it goes (a state
+// with no county, say), and its tally
+type dataRow struct {
+	regions []string
+	tally   float64
+}
+
+// the id of a region at a level, from its value and the id of its parent
+func regionId(level config.LevelParams, parent, value string) string {
+	id := s.NewReplacer("%parent%", parent, "%id%", value).Replace(level.Join)
+	return s.ReplaceAll(id, " ", "_")
+}
+
+// roll rows up into every level of the hierarchy. A region's tally is the sum
+// or the largest of the tallies of the rows within it, or with 'distinct',
+// how many regions one level down have a (non-zero) tally; at the deepest
+// level, that's how many rows do.
+func rollup(levels []config.LevelParams, rows []dataRow) *regionData {
+	data := newRegionData(len(levels))
+	distinct := make([]map[string]map[string]bool, len(levels))
+	for i := range levels {
+		distinct[i] = make(map[string]map[string]bool)
+	}
+
+	for _, row := range rows {
+		var ids []string
+		parent := ""
+		for i, value := range row.regions[:min(len(row.regions), len(levels))] {
+			value = s.TrimSpace(value)
+			if len(value) == 0 {
+				break
+			}
+			id := regionId(levels[i], parent, value)
+			if i > 0 {
+				data.parents[i][id] = parent
+			}
+			ids = append(ids, id)
+			parent = id
+		}
+
+		for i, id := range ids {
+			tallies := data.tallies[i]
+			switch levels[i].Rollup {
+			case "max":
+				if t, ok := tallies[id]; !ok || row.tally > t {
+					tallies[id] = row.tally
+				}
+			case "distinct":
+				tallies[id] += 0
+				if row.tally <= 0 {
+					continue
+				}
+				if i == len(levels)-1 {
+					tallies[id]++
+				} else if i+1 < len(ids) {
+					if distinct[i][id] == nil {
+						distinct[i][id] = make(map[string]bool)
+					}
+					distinct[i][id][ids[i+1]] = true
+					tallies[id] = float64(len(distinct[i][id]))
+				}
+			default:
+				tallies[id] += row.tally
+			}
+		}
+	}
+	return data
+}
+
+// tallies by region id alone, which stand for every level (as inline_data
+// does for its map). A region's parent is the longest other region whose id
+// and an underscore start its own, e.g. MN for MN_Hennepin.
+func flatData(levels int, tallies map[string]float64) *regionData {
+	data := newRegionData(levels)
+	for i := range levels {
+		for id, tally := range tallies {
+			data.tallies[i][id] += tally
+			if i == 0 {
+				continue
+			}
+			for j := len(id) - 1; j > 0; j-- {
+				if _, ok := tallies[id[:j]]; id[j] == '_' && ok {
+					data.parents[i][id] = id[:j]
+					break
+				}
+			}
+		}
+	}
+	return data
+}
+
+// keep only the regions in parent regions that are on the map, i.e. that
+// have a group whose id starts "<parent id>_". Regions whose parent isn't
+// known (from inline_data, say) are kept if their own id starts that way;
+// with no parents at all, there's nothing to go by, so all are kept. This is
+// so that regions outside the map don't cause error messages, while those on
+// it with a different (incorrect) name in the data still do.
+func pruneRegions(svg *svgxml.SVG, data map[string]float64, parents map[string]string) map[string]float64 {
+	if len(parents) == 0 {
+		return data
+	}
+
+	onMap := make(map[string]bool)
+	for _, parent := range parents {
+		if _, ok := onMap[parent]; ok {
+			continue
+		}
+		onMap[parent] = false
+		for _, g := range svg.G {
+			if s.HasPrefix(g.Id, parent+"_") {
+				onMap[parent] = true
+				break
+			}
+		}
+	}
+
+	pruned := make(map[string]float64)
+	for id, count := range data {
+		if parent, ok := parents[id]; ok {
+			if onMap[parent] {
+				pruned[id] = count
+			}
+			continue
+		}
+		for parent, ok := range onMap {
+			if ok && s.HasPrefix(id, parent+"_") {
+				pruned[id] = count
+				break
+			}
+		}
+	}
+	return pruned
+}
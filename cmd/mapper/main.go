@@ -1,23 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"image"
-	"image/draw"
-	"image/png"
+	"fmt"
 	"io"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
-	re "regexp"
 	"slices"
-	"strconv"
 	s "strings"
 	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/jeff-blank/mapper/pkg/config"
-	"github.com/jeff-blank/svgxml"
-	_ "github.com/lib/pq"
+	"github.com/jeff-blank/mapper/pkg/database"
+	_ "github.com/jeff-blank/mapper/pkg/database/drivers"
+	"github.com/jeff-blank/mapper/pkg/render"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -26,13 +27,30 @@ type IntArray []int
 
 func main() {
 	var (
-		wg          sync.WaitGroup
-		state_data  map[string]int
-		county_data map[string]int
+		wg     sync.WaitGroup
+		global *regionData
+		err    error
 	)
 
 	configFile := flag.String("conf", "mapper.yml", "configuration file")
 	logDebug := flag.Bool("d", false, "debug-level logging")
+	checkConfig := flag.Bool("check", false, "check the configuration file and exit")
+	groups := flag.String("group", "", "only the maps in these groups (comma-separated)")
+	names := flag.String("name", "", "only the maps with these names (comma-separated)")
+	outputs := flag.String("output", "", "only the maps whose outfile matches one of these globs (comma-separated)")
+	list := flag.Bool("list", false, "list the selected maps and their settings and exit")
+	failFast := flag.Bool("fail-fast", false, "stop drawing maps when one fails")
+	report := flag.Bool("report", false, "report how each map's data and regions match instead of drawing maps")
+	reportFormat := flag.String("report-format", "text", "format of the -report output: text or json")
+	params := make(map[string]string)
+	flag.Func("param", "`name=value` for a :name parameter in the database's queries (may be repeated)", func(arg string) error {
+		name, value, ok := s.Cut(arg, "=")
+		if !ok || len(name) == 0 {
+			return fmt.Errorf("'%s' is not name=value", arg)
+		}
+		params[name] = value
+		return nil
+	})
 	flag.Parse()
 
 	if *logDebug {
@@ -41,161 +59,196 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	cfg := config.New(*configFile)
-
-	// make sorted list of keys (minimum counts) for later comparisons
-	mincount := make([]int, len(cfg.Colours))
-	i := 0
-	for k := range cfg.Colours {
-		k_i, _ := strconv.ParseInt(k, 0, 64)
-		mincount[i] = int(k_i)
-		i++
+	if *checkConfig {
+		cfg, problems, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the configuration doesn't know which drivers mapper has
+		if dbtype := cfg.DbParam["type"]; len(dbtype) > 0 {
+			if err := database.CheckType(dbtype); err != nil {
+				problems = append(problems, config.Problem{Path: "database.type", Message: err.Error()})
+			}
+		}
+		for _, p := range problems {
+			fmt.Printf("%s:%s\n", *configFile, p)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", *configFile)
+		return
 	}
 
-	slices.Sort(mincount)
+	if *reportFormat != "text" && *reportFormat != "json" {
+		log.Fatalf("unknown report format '%s'", *reportFormat)
+	}
 
-	re_fill, err := re.Compile(`(fill:#)......`)
+	cfg := config.New(*configFile)
+	cfg.ParamOverrides = params
+	cfg.Maps, err = selectMaps(cfg, *groups, *names, *outputs)
 	if err != nil {
-		log.Fatal("re.Compile() fill: ", err)
+		log.Fatal(err)
 	}
 
-	re_svgext, err := re.Compile(`\.svg$`)
-	if err != nil {
-		log.Fatal("re.Compile() .svg: ", err)
+	if *list {
+		if err := listMaps(os.Stdout, cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	if cfg.DbParam["type"] != "" {
-		state_data, county_data = dbData(cfg.DbParam)
+	switch flag.Arg(0) {
+	case "":
+	case "serve":
+		serve(cfg)
+		return
+	case "suggest-aliases":
+		if err := suggestAliases(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "render-snapshot":
+		if flag.NArg() < 2 {
+			log.Fatal("usage: mapper render-snapshot <snapshot file>...")
+		}
+		failed := false
+		for _, file := range flag.Args()[1:] {
+			if err := renderSnapshot(cfg, file); err != nil {
+				log.Errorf("%s: %v", file, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Fatalf("unknown command '%s'", flag.Arg(0))
 	}
 
-	for maptype, mapset := range cfg.Maps {
-		var data map[string]int
+	started := time.Now()
+	global, err = globalData(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		if maptype == "states" {
-			data = state_data
-		} else {
-			data = county_data
+	if *report {
+		if err := reportMaps(cfg, global, *reportFormat); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		for _, attrs := range mapset {
-			wg.Add(1)
-			go func(attrs config.MapSet, maptype string, mapdata_default map[string]int) {
-
-				var mapdata map[string]int
-
-				if len(cfg.DbParam["where"]) > 0 && len(attrs.DbWhere) > 0 {
-					newDbConfig := make(map[string]string)
-					for k, v := range cfg.DbParam {
-						log.Debugf("newDbConfig[%s] = %s", k, v)
-						newDbConfig[k] = v
-					}
-					newDbConfig["where"] = cfg.DbParam["where"] + " and " + attrs.DbWhere
-					state_new, county_new := dbData(newDbConfig)
-					if maptype == "states" {
-						mapdata = state_new
-					} else {
-						mapdata = county_new
-					}
-					log.Debug(mapdata)
-				} else {
-					mapdata = mapdata_default
+	// catch bad colours before drawing anything
+	var results []*mapResult
+	for _, maptype := range slices.Sorted(maps.Keys(cfg.Maps)) {
+		for _, attrs := range cfg.Maps[maptype] {
+			colourParams := cfg.MapColours(maptype, attrs)
+			if len(colourParams.Classify.Method) == 0 {
+				if _, err := render.NewScale(colourParams.Colours, colourParams.ColourMode, colourParams.ColourSpace); err != nil {
+					log.Fatalf("%s: %v", attrs.OutputFile, err)
 				}
+			}
+			results = append(results, &mapResult{group: maptype, attrs: attrs})
+		}
+	}
 
-				defer wg.Done()
-				//defer os.Stderr.Close()
-
-				attrs.InputFile = filepath.FromSlash(attrs.InputFile)
-				mapsvg, err := svgxml.NewFromFile(attrs.InputFile)
-				if err != nil {
-					log.Errorf("%s || can't create SVG object from %s", err.Error(), attrs.InputFile)
-					return
+	// with -fail-fast, the first failure stops the maps that haven't been
+	// written yet; those being written are finished
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, result := range results {
+		wg.Add(1)
+		go func(result *mapResult) {
+			defer wg.Done()
+			result.err = drawMap(ctx, cfg, result.group, result.attrs, global, started)
+			if result.err != nil && !errors.Is(result.err, context.Canceled) {
+				log.Errorf("%s: %v", result.attrs.OutputFile, result.err)
+				if *failFast {
+					cancel()
 				}
+			}
+		}(result)
+	}
+	wg.Wait()
 
-				if len(attrs.InlineData) > 0 {
-					mapdata = attrs.InlineData
-				}
-				if maptype == "counties" {
-					mapdata = pruneCounties(mapsvg, mapdata, state_data)
-				}
+	if !summarize(os.Stdout, results) {
+		os.Exit(1)
+	}
+}
 
-				errlist, err := colourSvgData(mapsvg, mapdata, re_fill, cfg.Colours, mincount, attrs)
-				if err != nil {
-					log.Fatal(err)
-				}
-				if len(errlist) > 0 {
-					for _, errmsg := range errlist {
-						log.Warnf("%s: %s\n", attrs.InputFile, errmsg)
-					}
-				}
+// how drawing one map went
+type mapResult struct {
+	group string
+	attrs config.MapSet
+	err   error
+}
 
-				attrs.OutputFile = filepath.FromSlash(attrs.OutputFile)
-				if dotSvg := re_svgext.FindStringIndex(attrs.OutputFile); dotSvg == nil {
-					// going to call ImageMagick's 'convert' because I can't find
-					// a damn SVG package that can write to a non-SVG image and I
-					// don't have the chops to write one.
-					imagemagick := cfg.General["imagemagick_convert"]
-					if len(imagemagick) == 0 {
-						imagemagick = "convert"
-					}
-					cmd := exec.Command(imagemagick, "svg:-", "-resize", attrs.OutputSize, "png:-")
-					convert_stdin, err := cmd.StdinPipe()
-					if err != nil {
-						log.Error("exec convert: ", err)
-						return
-					}
-					go func() {
-						defer convert_stdin.Close()
-						svgOut, err := mapsvg.GetXml()
-						if err == nil {
-							io.Writer.Write(convert_stdin, svgOut)
-						} else {
-							log.Error(err)
-							return
-						}
-					}()
-
-					// grab PNG data and cram it into an RGBA image
-					png_data, err := cmd.Output()
-					if err != nil {
-						log.Debugf("%s svg:- -resize %s png:-", imagemagick, attrs.OutputSize)
-						log.Error("read from convert: ", err)
-						return
-					}
-					png_reader := s.NewReader(string(png_data))
-					img, _, err := image.Decode(png_reader)
-					b := img.Bounds()
-					imgRbga := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
-					draw.Draw(imgRbga, imgRbga.Bounds(), img, b.Min, draw.Src)
-
-					if len(cfg.LADefaults.LegendFontFile) > 0 || len(attrs.LegendAnnotate.LegendFontFile) > 0 {
-						ahHatesLegends(imgRbga, mincount, cfg.Colours, cfg.LADefaults, attrs)
-					}
-
-					annotate(imgRbga, cfg.LADefaults, attrs, mapdata)
-					outfile_handle, err := os.Create(attrs.OutputFile)
-					if err != nil {
-						log.Errorf("can't create '%s': %v", attrs.OutputFile, err)
-						return
-					}
-					if err := png.Encode(outfile_handle, imgRbga); err != nil {
-						outfile_handle.Close()
-						log.Fatalf("close png file '%s': %v", attrs.OutputFile, err)
-					}
-				} else {
-					ahHatesLegends(mapsvg, mincount, cfg.Colours, cfg.LADefaults, attrs)
-					log.Debugf("main: default font size=%+v", cfg.LADefaults.AnnotationFontSize)
-					annotate(mapsvg, cfg.LADefaults, attrs, mapdata)
-					mapsvg.AddBackground("#ffffff")
-					err = mapsvg.WriteFileIndented(attrs.OutputFile, "", "  ")
-					if err != nil {
-						log.Error(err)
-						return
-					}
-				}
+// draw one map and write it, with its snapshot and delta baseline. Checks
+// ctx before starting and before writing anything.
+func drawMap(ctx context.Context, cfg *config.Config, maptype string, attrs config.MapSet, global *regionData, started time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	attrs.OutputFile = filepath.FromSlash(attrs.OutputFile)
 
-			}(attrs, maptype, data)
+	if len(attrs.Animation.DateColumn) > 0 {
+		return animateMap(cfg, maptype, attrs)
+	}
+
+	parents, mapdata, err := mapData(cfg, maptype, attrs, global)
+	if err != nil {
+		return fmt.Errorf("can't read data: %v", err)
+	}
+
+	in, err := loadMapInputs(cfg, maptype, attrs, parents, mapdata)
+	if err != nil {
+		return err
+	}
+	out, err := renderMap(cfg, maptype, attrs, in, outputFormat(attrs.OutputFile))
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := writeMap(attrs.OutputFile, out); err != nil {
+		return err
+	}
+	if snapshotEnabled(cfg, attrs) {
+		file, err := writeSnapshot(maptype, attrs, out, started)
+		if err != nil {
+			return fmt.Errorf("snapshot: %v", err)
 		}
+		log.Infof("%s: data saved in %s", attrs.OutputFile, file)
 	}
 
-	wg.Wait()
+	if attrs.Delta.UpdateBaseline {
+		if err := saveBaseline(attrs.Delta.Baseline, out.data); err != nil {
+			return fmt.Errorf("save baseline: %v", err)
+		}
+	}
+	return nil
+}
+
+// a table of what was drawn and what wasn't; false if anything wasn't
+func summarize(w io.Writer, results []*mapResult) bool {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tOUTPUT\tRESULT")
+	for _, r := range results {
+		status := "ok"
+		if errors.Is(r.err, context.Canceled) {
+			status = "skipped"
+			ok = false
+		} else if r.err != nil {
+			status = "failed: " + r.err.Error()
+			ok = false
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.group, r.attrs.OutputFile, status)
+	}
+	tw.Flush()
+	return ok
 }
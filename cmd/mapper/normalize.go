@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	s "strings"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/database"
+	"github.com/jeff-blank/mapper/pkg/query"
+	log "github.com/sirupsen/logrus"
+)
+
+// a map's own normalization settings, or else the global ones
+func normalizeParams(cfg *config.Config, attrs config.MapSet) config.NormalizeParams {
+	if len(attrs.Normalize.DenominatorFile) > 0 || len(attrs.Normalize.DenominatorQuery) > 0 {
+		return attrs.Normalize
+	}
+	return cfg.Normalize
+}
+
+func normalizing(params config.NormalizeParams) bool {
+	return len(params.DenominatorFile) > 0 || len(params.DenominatorQuery) > 0
+}
+
+// the values a map is coloured by: its tallies, or with normalization, each
+// tally divided by its region's denominator (by the same ids as the data)
+// and multiplied by the multiplier. Regions without a (non-zero) denominator
+// are left out and listed.
+func mapValues(cfg *config.Config, attrs config.MapSet, data map[string]float64, denominators map[string]float64) (map[string]float64, []string) {
+	values := make(map[string]float64, len(data))
+	params := normalizeParams(cfg, attrs)
+	if !normalizing(params) {
+		for id, count := range data {
+			values[id] = count
+		}
+		return values, nil
+	}
+
+	multiplier := params.Multiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+
+	var missing []string
+	for id, count := range data {
+		d := denominators[id]
+		if d == 0 {
+			if count > 0 {
+				missing = append(missing, "'"+id+"' has no denominator")
+			}
+			continue
+		}
+		values[id] = count / d * multiplier
+	}
+	return values, missing
+}
+
+// region id -> denominator, from a file or a query (with the map's params)
+func denominatorData(cfg *config.Config, attrs config.MapSet, params config.NormalizeParams) (map[string]float64, error) {
+	if len(params.DenominatorQuery) > 0 {
+		return dbDenominators(cfg.DbParam, params.DenominatorQuery, queryParams(cfg, attrs))
+	}
+
+	f, err := os.Open(params.DenominatorFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	format := "csv"
+	if s.ToLower(filepath.Ext(params.DenominatorFile)) == ".tsv" {
+		format = "tsv"
+	}
+	dataHeader := dataFileParams(cfg.DataSource, attrs.DataSource).DataHeader
+	return csvDenominators(f, format, params.DenominatorColumn, dataHeader, params.DenominatorFile)
+}
+
+// rows of region id and denominator; ids with spaces (e.g. "MN Hennepin")
+// are matched like the database's state and county are
+func dbDenominators(dbconfig map[string]string, sql string, params query.Params) (map[string]float64, error) {
+	dbh, style, err := database.Open(dbconfig)
+	if err != nil {
+		return nil, err
+	}
+	defer dbh.Close()
+
+	stmt, args, err := query.Bind(sql, params, style)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("%s %v", stmt, args)
+	rows, err := dbh.Query(stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("dbh.Query(): %v", err)
+	}
+	defer rows.Close()
+
+	denominators := make(map[string]float64)
+	for rows.Next() {
+		var id string
+		var d float64
+		if err := rows.Scan(&id, &d); err != nil {
+			return nil, fmt.Errorf("rows.Scan(): %v", err)
+		}
+		denominators[s.ReplaceAll(id, " ", "_")] = d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %v", err)
+	}
+	return denominators, nil
+}
+
+// CSV/TSV with the region id in the first column and the denominator in the
+// named (or numbered) column, the second by default. Whether the first row
+// is a header is up to data_header, as for data files (see csvHeader()).
+func csvDenominators(r io.Reader, format, column, dataHeader, file string) (map[string]float64, error) {
+	delim, err := csvDelimiter(format, "")
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(r)
+	reader.Comma = delim
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	denominators := make(map[string]float64)
+	first, err := reader.Read()
+	if err == io.EOF {
+		return denominators, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	header, err := csvHeader(first, dataHeader, file)
+	if err != nil {
+		return nil, err
+	}
+	if len(column) == 0 {
+		column = "2"
+	}
+	col, err := csvColumn(header, column, column, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	record := first
+	if header != nil {
+		record, err = reader.Read()
+	}
+	for ; err == nil; record, err = reader.Read() {
+		line, _ := reader.FieldPos(0)
+		if col >= len(record) {
+			return nil, fmt.Errorf("line %d: %d fields, need at least %d", line, len(record), col+1)
+		}
+		d, err := strconv.ParseFloat(s.TrimSpace(record[col]), 64)
+		if err != nil || math.IsNaN(d) || math.IsInf(d, 0) {
+			return nil, fmt.Errorf("line %d: denominator '%s' is not a number", line, record[col])
+		}
+		denominators[s.ReplaceAll(s.TrimSpace(record[0]), " ", "_")] = d
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return denominators, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	s "strings"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/query"
+	"github.com/jeff-blank/mapper/pkg/render"
+	"github.com/jeff-blank/svgxml"
+	log "github.com/sirupsen/logrus"
+)
+
+// the tallies shared by all maps, from the data file or the database
+func globalData(cfg *config.Config) (*regionData, error) {
+	if len(cfg.DataSource.DataFile) > 0 {
+		data, err := fileData(cfg.DataSource, cfg.Hierarchy())
+		if err != nil {
+			return nil, fmt.Errorf("fileData(): %v", err)
+		}
+		return data, nil
+	} else if cfg.DbParam["type"] != "" {
+		return dbData(cfg.DbParam, cfg.Hierarchy(), queryParams(cfg, config.MapSet{}))
+	}
+	return nil, nil
+}
+
+// whether mapData() starts a map's tallies from the global ones, rather than
+// querying the database again or reading its own data file
+func usesGlobalData(cfg *config.Config, attrs config.MapSet, conditions ...query.Condition) bool {
+	if len(attrs.DataSource.DataFile) > 0 {
+		return false
+	}
+	requery := len(conditions) > 0 || len(attrs.DbWhere) > 0 || len(attrs.Params) > 0
+	return len(cfg.DbParam["type"]) == 0 || !requery
+}
+
+// gather the tallies for one map, starting from the global ones: the map's
+// own db_where or params (plus any extra conditions) re-query the database,
+// and its data_file or inline_data replace the data altogether. Returns the
+// parent of each region at the map's level (for pruning) and the tallies for
+// the map itself.
+func mapData(cfg *config.Config, maptype string, attrs config.MapSet, global *regionData, conditions ...query.Condition) (map[string]string, map[string]float64, error) {
+	data := global
+
+	if len(attrs.DbWhere) > 0 {
+		conditions = append([]query.Condition{{SQL: attrs.DbWhere, Params: queryParams(cfg, attrs)}}, conditions...)
+	}
+	if len(cfg.DbParam["type"]) > 0 && (len(conditions) > 0 || len(attrs.Params) > 0) {
+		var err error
+		data, err = dbData(cfg.DbParam, cfg.Hierarchy(), queryParams(cfg, attrs), conditions...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(attrs.DataSource.DataFile) > 0 {
+		var err error
+		data, err = fileData(dataFileParams(cfg.DataSource, attrs.DataSource), cfg.Hierarchy())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var (
+		parents map[string]string
+		mapdata map[string]float64
+	)
+	if data != nil {
+		level := cfg.MapLevel(maptype, attrs)
+		parents = data.parents[level]
+		mapdata = data.tallies[level]
+		log.Debug(mapdata)
+	}
+
+	if len(attrs.InlineData) > 0 {
+		mapdata = attrs.InlineData
+	}
+
+	return parents, mapdata, nil
+}
+
+// everything a map is drawn from besides its SVG and settings: its tallies
+// (see mapData()) and, when the map uses them, its aliases, the denominators
+// it's normalized by and the baseline it's compared with
+type mapInputs struct {
+	parents      map[string]string
+	data         map[string]float64
+	aliases      map[string]string
+	denominators map[string]float64
+	baseline     map[string]float64
+}
+
+// read the aliases, denominators and baseline that go with a map's tallies
+func loadMapInputs(cfg *config.Config, maptype string, attrs config.MapSet, parents map[string]string, mapdata map[string]float64) (*mapInputs, error) {
+	in := &mapInputs{parents: parents, data: mapdata}
+	var err error
+	if in.aliases, err = loadAliases(aliasFile(attrs)); err != nil {
+		return nil, err
+	}
+	if params := normalizeParams(cfg, attrs); normalizing(params) {
+		if in.denominators, err = denominatorData(cfg, attrs, params); err != nil {
+			return nil, fmt.Errorf("normalize: %v", err)
+		}
+	}
+	if deltaMode(attrs) {
+		if in.baseline, err = baselineData(cfg, maptype, attrs); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// a map ready to be written out, as one of: the SVG, the rasterized image,
+// or an HTML page
+type renderedMap struct {
+	svg  *svgxml.SVG
+	img  *image.RGBA
+	html []byte
+
+	// the tallies the map was coloured with, and the denominators they were
+	// normalized by (nil if they weren't)
+	data         map[string]float64
+	denominators map[string]float64
+}
+
+// the output format for a file name: svg, html or (for anything else) png
+func outputFormat(outfile string) string {
+	switch s.ToLower(filepath.Ext(outfile)) {
+	case ".svg":
+		return "svg"
+	case ".html", ".htm":
+		return "html"
+	}
+	return "png"
+}
+
+// colour a map's SVG with its data and add the legend and annotations, then
+// produce the output format (png, svg or html)
+func renderMap(cfg *config.Config, maptype string, attrs config.MapSet, in *mapInputs, format string) (*renderedMap, error) {
+	m, err := render.Load(attrs, cfg.LADefaults)
+	if err != nil {
+		return nil, err
+	}
+	m.Rasterizer = cfg.General["rasterizer"]
+	m.ImageMagick = cfg.General["imagemagick_convert"]
+	m.RegionUrl = cfg.General["region_url"]
+
+	mapdata := in.data
+	if cfg.MapLevel(maptype, attrs) > 0 {
+		mapdata = pruneRegions(m.SVG(), mapdata, in.parents)
+	}
+
+	// from here on, regions go by their ids in the SVG
+	mapdata = aliasData(mapdata, in.aliases)
+
+	// normalized or not, the values the map is coloured by
+	denominators := aliasData(in.denominators, in.aliases)
+	values, missing := mapValues(cfg, attrs, mapdata, denominators)
+	for _, errmsg := range missing {
+		log.Warnf("%s: %s", attrs.OutputFile, errmsg)
+	}
+	var rates map[string]float64
+	if normalizing(normalizeParams(cfg, attrs)) {
+		rates = values
+	}
+
+	scale, err := mapScale(cfg, maptype, attrs, values)
+	if err != nil {
+		return nil, err
+	}
+	errlist, err := m.Colour(mapdata, rates, scale)
+	if err != nil {
+		return nil, err
+	}
+	if len(errlist) > 0 {
+		for _, errmsg := range errlist {
+			log.Warnf("%s: %s\n", m.Attrs.InputFile, errmsg)
+		}
+		log.Infof("%s: 'mapper suggest-aliases' can suggest aliases for regions not found", m.Attrs.InputFile)
+	}
+
+	if deltaMode(attrs) {
+		// baseline files have the ids the map had; data from the database
+		// has the data's
+		baseline := in.baseline
+		if len(attrs.Delta.Since) > 0 {
+			baseline = aliasData(baseline, in.aliases)
+		}
+		var ids []string
+		if baseline != nil {
+			ids = newRegions(values, baseline, scale)
+			log.Debugf("%s: new regions: %v", attrs.OutputFile, ids)
+			if err := m.Highlight(ids); err != nil {
+				return nil, err
+			}
+		}
+		decimals := render.DecimalPlaces(cfg.LADefaults.AnnotationDecimals, attrs.LegendAnnotate.AnnotationDecimals)
+		m.Attrs.LegendAnnotate.Annotation = deltaAnnotation(attrs.LegendAnnotate.Annotation, ids, mapdata, decimals)
+	}
+
+	switch format {
+	case "svg":
+		doc, err := m.Document()
+		if err != nil {
+			return nil, err
+		}
+		return &renderedMap{svg: doc, data: mapdata, denominators: denominators}, nil
+	case "html":
+		page, err := m.Page()
+		if err != nil {
+			return nil, err
+		}
+		return &renderedMap{html: page, data: mapdata, denominators: denominators}, nil
+	}
+
+	img, err := m.Image()
+	if err != nil {
+		return nil, err
+	}
+	return &renderedMap{img: img, data: mapdata, denominators: denominators}, nil
+}
+
+// the colour scale for a map: its colours, or with classification, colours
+// from its values
+func mapScale(cfg *config.Config, maptype string, attrs config.MapSet, values map[string]float64) (*render.Scale, error) {
+	colourParams := cfg.MapColours(maptype, attrs)
+	colours := colourParams.Colours
+	if len(colourParams.Classify.Method) > 0 {
+		var err error
+		colours, err = render.ClassifyColours(values, colourParams.Classify)
+		if err != nil {
+			return nil, fmt.Errorf("%s map: %v", maptype, err)
+		}
+		log.Debugf("%s: classified colours: %v", attrs.OutputFile, colours)
+	}
+	return render.NewScale(colours, colourParams.ColourMode, colourParams.ColourSpace)
+}
+
+// write a rendered map to its output file
+func writeMap(outfile string, out *renderedMap) error {
+	switch {
+	case out.img != nil:
+		outfile_handle, err := os.Create(outfile)
+		if err != nil {
+			return fmt.Errorf("can't create '%s': %v", outfile, err)
+		}
+		if err := png.Encode(outfile_handle, out.img); err != nil {
+			outfile_handle.Close()
+			return fmt.Errorf("encode png file '%s': %v", outfile, err)
+		}
+		return outfile_handle.Close()
+	case out.html != nil:
+		return os.WriteFile(outfile, out.html, 0644)
+	}
+	return out.svg.WriteFileIndented(outfile, "", "  ")
+}
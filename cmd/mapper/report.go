@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	s "strings"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/render"
+)
+
+// how well one map's data and SVG match: the region ids with data that are
+// on the map, those that aren't, and the map's paths that get no data
+type mapReport struct {
+	Group         string   `json:"group"`
+	InputFile     string   `json:"infile"`
+	OutputFile    string   `json:"outfile"`
+	Matched       []string `json:"matched"`
+	UnmatchedData []string `json:"unmatched_data"`
+	Untouched     []string `json:"untouched"`
+	Counts        struct {
+		Matched       int `json:"matched"`
+		UnmatchedData int `json:"unmatched_data"`
+		Untouched     int `json:"untouched"`
+	} `json:"counts"`
+	// percentages of the data keys that are on the map, and of the map's
+	// paths that have data
+	DataCoverage float64 `json:"data_coverage"`
+	MapCoverage  float64 `json:"map_coverage"`
+}
+
+// compare a map's data with its SVG, the way renderMap() would colour it:
+// after pruning and aliases, and leaving out regions in ignore_missing.
+// Regions with a zero tally count as having no data.
+func reportMap(cfg *config.Config, maptype string, attrs config.MapSet, global *regionData) (*mapReport, error) {
+	parents, mapdata, err := mapData(cfg, maptype, attrs, global)
+	if err != nil {
+		return nil, err
+	}
+	m, err := render.Load(attrs, cfg.LADefaults)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MapLevel(maptype, attrs) > 0 {
+		mapdata = pruneRegions(m.SVG(), mapdata, parents)
+	}
+	aliases, err := loadAliases(aliasFile(attrs))
+	if err != nil {
+		return nil, err
+	}
+	mapdata = aliasData(mapdata, aliases)
+
+	ids, err := m.Regions()
+	if err != nil {
+		return nil, err
+	}
+	onMap := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		onMap[id] = true
+	}
+
+	report := &mapReport{
+		Group:         maptype,
+		InputFile:     attrs.InputFile,
+		OutputFile:    attrs.OutputFile,
+		Matched:       []string{},
+		UnmatchedData: []string{},
+		Untouched:     []string{},
+	}
+	for _, id := range slices.Sorted(maps.Keys(mapdata)) {
+		if mapdata[id] == 0 || attrs.IgnoreMissing[id] {
+			continue
+		}
+		if onMap[id] {
+			report.Matched = append(report.Matched, id)
+		} else {
+			report.UnmatchedData = append(report.UnmatchedData, id)
+		}
+	}
+	for _, id := range ids {
+		if mapdata[id] == 0 {
+			report.Untouched = append(report.Untouched, id)
+		}
+	}
+	slices.Sort(report.Untouched)
+
+	report.Counts.Matched = len(report.Matched)
+	report.Counts.UnmatchedData = len(report.UnmatchedData)
+	report.Counts.Untouched = len(report.Untouched)
+	report.DataCoverage = percent(len(report.Matched), len(report.Matched)+len(report.UnmatchedData))
+	report.MapCoverage = percent(len(report.Matched), len(ids))
+	return report, nil
+}
+
+// report on every map, in group and then config file order, to stdout
+func reportMaps(cfg *config.Config, global *regionData, format string) error {
+	var reports []*mapReport
+	for _, maptype := range slices.Sorted(maps.Keys(cfg.Maps)) {
+		for _, attrs := range cfg.Maps[maptype] {
+			report, err := reportMap(cfg, maptype, attrs, global)
+			if err != nil {
+				return fmt.Errorf("%s: %v", attrs.OutputFile, err)
+			}
+			reports = append(reports, report)
+		}
+	}
+	return writeReports(os.Stdout, reports, format)
+}
+
+// n as a percentage of total, to one decimal place
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)*1000/float64(total)) / 10
+}
+
+// write reports as text or as a JSON array
+func writeReports(w io.Writer, reports []*mapReport, format string) error {
+	if format == "json" {
+		out, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	}
+
+	for i, r := range reports {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s (%s, %s)\n", r.OutputFile, r.Group, r.InputFile)
+		fmt.Fprintf(w, "  matched:         %d of %d paths (map coverage %.1f%%)\n", r.Counts.Matched, r.Counts.Matched+r.Counts.Untouched, r.MapCoverage)
+		fmt.Fprintf(w, "  unmatched data:  %d of %d keys (data coverage %.1f%%)\n", r.Counts.UnmatchedData, r.Counts.Matched+r.Counts.UnmatchedData, r.DataCoverage)
+		writeIds(w, r.UnmatchedData)
+		fmt.Fprintf(w, "  untouched paths: %d\n", r.Counts.Untouched)
+		writeIds(w, r.Untouched)
+	}
+	return nil
+}
+
+// ids, several to a line
+func writeIds(w io.Writer, ids []string) {
+	line := ""
+	for _, id := range ids {
+		if len(line) > 0 && len(line)+len(id) > 72 {
+			fmt.Fprintf(w, "    %s\n", s.TrimSpace(line))
+			line = ""
+		}
+		line += id + " "
+	}
+	if len(line) > 0 {
+		fmt.Fprintf(w, "    %s\n", s.TrimSpace(line))
+	}
+}
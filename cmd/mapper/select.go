@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"slices"
+	s "strings"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"go.yaml.in/yaml/v4"
+)
+
+// the maps to work on: those that match every selection given. Each is a
+// comma-separated list, of groups, of map names, or of globs for output
+// files (matched against the whole outfile and against its base name).
+func selectMaps(cfg *config.Config, groups, names, outputs string) (map[string][]config.MapSet, error) {
+	if len(groups) == 0 && len(names) == 0 && len(outputs) == 0 {
+		return cfg.Maps, nil
+	}
+	for _, glob := range splitList(outputs) {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("output glob '%s': %v", glob, err)
+		}
+	}
+
+	selected := make(map[string][]config.MapSet)
+	for group, mapset := range cfg.Maps {
+		if len(groups) > 0 && !slices.Contains(splitList(groups), group) {
+			continue
+		}
+		for _, attrs := range mapset {
+			if len(names) > 0 && !slices.Contains(splitList(names), attrs.Name) {
+				continue
+			}
+			if len(outputs) > 0 && !outputMatches(splitList(outputs), attrs.OutputFile) {
+				continue
+			}
+			selected[group] = append(selected[group], attrs)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no maps match the selection")
+	}
+	return selected, nil
+}
+
+func outputMatches(globs []string, outfile string) bool {
+	outfile = filepath.FromSlash(outfile)
+	for _, glob := range globs {
+		glob = filepath.FromSlash(glob)
+		if ok, _ := filepath.Match(glob, outfile); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, filepath.Base(outfile)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range s.Split(list, ",") {
+		if item = s.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// one map's settings as it will be drawn: with the global and group
+// settings it inherits filled in
+type mapListing struct {
+	Group              string            `yaml:"group"`
+	Name               string            `yaml:"name,omitempty"`
+	InputFile          string            `yaml:"infile"`
+	OutputFile         string            `yaml:"outfile"`
+	Format             string            `yaml:"format"`
+	OutputSize         string            `yaml:"outsize,omitempty"`
+	Level              string            `yaml:"level"`
+	Data               string            `yaml:"data"`
+	DbWhere            string            `yaml:"db_where,omitempty"`
+	Params             map[string]string `yaml:"params,omitempty"`
+	Aliases            string            `yaml:"aliases,omitempty"`
+	Colours            map[string]string `yaml:"colours,omitempty"`
+	ColourMode         string            `yaml:"colour_mode,omitempty"`
+	ColourSpace        string            `yaml:"colour_space,omitempty"`
+	Classify           *classifyListing  `yaml:"classification,omitempty"`
+	LegendGravity      string            `yaml:"legend_gravity,omitempty"`
+	LegendOrient       string            `yaml:"legend_orient,omitempty"`
+	LegendFontFile     string            `yaml:"legend_fontfile,omitempty"`
+	LegendFontSize     float64           `yaml:"legend_fontsize,omitempty"`
+	AnnotationFontFile string            `yaml:"annotation_fontfile,omitempty"`
+	AnnotationFontSize float64           `yaml:"annotation_fontsize,omitempty"`
+	Animated           bool              `yaml:"animated,omitempty"`
+	Delta              bool              `yaml:"delta,omitempty"`
+	Snapshot           bool              `yaml:"snapshot,omitempty"`
+}
+
+type classifyListing struct {
+	Method      string   `yaml:"method"`
+	Classes     int      `yaml:"classes,omitempty"`
+	Palette     []string `yaml:"palette,omitempty"`
+	PaletteName string   `yaml:"palette_name,omitempty"`
+}
+
+// write the selected maps' settings, by group and then in config file order
+func listMaps(w io.Writer, cfg *config.Config) error {
+	var listings []mapListing
+	for _, maptype := range slices.Sorted(maps.Keys(cfg.Maps)) {
+		for _, attrs := range cfg.Maps[maptype] {
+			listings = append(listings, listMap(cfg, maptype, attrs))
+		}
+	}
+	out, err := yaml.Marshal(listings)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func listMap(cfg *config.Config, maptype string, attrs config.MapSet) mapListing {
+	colours := cfg.MapColours(maptype, attrs)
+	defaults := cfg.LADefaults
+	own := attrs.LegendAnnotate
+	l := mapListing{
+		Group:              maptype,
+		Name:               attrs.Name,
+		InputFile:          attrs.InputFile,
+		OutputFile:         attrs.OutputFile,
+		Format:             outputFormat(attrs.OutputFile),
+		OutputSize:         attrs.OutputSize,
+		Level:              cfg.Hierarchy()[cfg.MapLevel(maptype, attrs)].Name,
+		DbWhere:            attrs.DbWhere,
+		Params:             cfg.QueryParams(attrs),
+		Aliases:            aliasFile(attrs),
+		ColourMode:         colours.ColourMode,
+		ColourSpace:        colours.ColourSpace,
+		LegendGravity:      firstString(own.LegendGravity, defaults.LegendGravity),
+		LegendOrient:       firstString(own.LegendOrient, defaults.LegendOrient),
+		LegendFontFile:     firstString(own.LegendFontFile, defaults.LegendFontFile),
+		LegendFontSize:     defaults.LegendFontSize,
+		AnnotationFontFile: firstString(own.AnnotationFontFile, defaults.AnnotationFontFile),
+		AnnotationFontSize: defaults.AnnotationFontSize,
+		Animated:           len(attrs.Animation.DateColumn) > 0,
+		Delta:              len(attrs.Delta.Baseline) > 0 || len(attrs.Delta.Since) > 0,
+		Snapshot:           snapshotEnabled(cfg, attrs),
+	}
+	if c := colours.Classify; len(c.Method) > 0 {
+		l.Classify = &classifyListing{c.Method, c.Classes, c.Palette, c.PaletteName}
+	} else {
+		l.Colours = colours.Colours
+	}
+	if own.LegendFontSize > 0 {
+		l.LegendFontSize = own.LegendFontSize
+	}
+	if own.AnnotationFontSize > 0 {
+		l.AnnotationFontSize = own.AnnotationFontSize
+	}
+
+	switch {
+	case len(attrs.InlineData) > 0:
+		l.Data = "inline_data"
+	case len(attrs.DataSource.DataFile) > 0:
+		l.Data = attrs.DataSource.DataFile
+	case len(cfg.DataSource.DataFile) > 0:
+		l.Data = cfg.DataSource.DataFile
+	case len(cfg.DbParam["type"]) > 0:
+		l.Data = "database"
+	default:
+		l.Data = "none"
+	}
+	return l
+}
+
+func firstString(values ...string) string {
+	for _, v := range values {
+		if len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"image/png"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	s "strings"
+	"sync"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/query"
+	"github.com/jeff-blank/mapper/pkg/raster"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the largest width or height a request's size can ask for (unless the
+	// map's own outsize is larger)
+	maxServeSide = 4096
+	// how many rendered maps are cached; the least recently used go first
+	maxCachedMaps = 64
+)
+
+// rendered maps, one per distinct request, kept until the data behind them
+// changes or they haven't been asked for in a while
+type renderCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	// the cachedMaps, most recently used first
+	lru *list.List
+}
+
+type cachedMap struct {
+	key string
+	// the map and filters, which decide its data; the same map in another
+	// size or format has the same data
+	dataKey     string
+	fingerprint string
+	contentType string
+	body        []byte
+}
+
+func newRenderCache() *renderCache {
+	return &renderCache{entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// the cached map for a request, if its data hasn't changed since
+func (c *renderCache) get(key, fingerprint string) (cachedMap, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.Value.(cachedMap).fingerprint != fingerprint {
+		return cachedMap{}, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(cachedMap), true
+}
+
+// cache a map, dropping the other sizes and formats of it that were made
+// from different data, and the least recently used maps beyond
+// maxCachedMaps
+func (c *renderCache) put(m cachedMap) {
+	c.Lock()
+	defer c.Unlock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if cm := e.Value.(cachedMap); cm.key == m.key || (cm.dataKey == m.dataKey && cm.fingerprint != m.fingerprint) {
+			c.lru.Remove(e)
+			delete(c.entries, cm.key)
+		}
+		e = next
+	}
+	c.entries[m.key] = c.lru.PushFront(m)
+	for c.lru.Len() > maxCachedMaps {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(cachedMap).key)
+	}
+}
+
+// serve every configured map at /maps/<group>/<outfile>, rendered from the
+// current data on each request
+func serve(cfg *config.Config) {
+	listen := cfg.Server.Listen
+	if len(listen) == 0 {
+		listen = ":8080"
+	}
+
+	cache := newRenderCache()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /maps/{group}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		serveMap(cfg, cache, w, r)
+	})
+
+	log.Infof("listening on %s", listen)
+	log.Fatal(http.ListenAndServe(listen, mux))
+}
+
+// query parameters:
+//
+//	format: png, svg or html (default: from the URL, then from the map's outfile)
+//	size:   output size, like outsize, up to maxServeSide pixels a side
+//	where:  the name of a filter from the server section; may be repeated
+func serveMap(cfg *config.Config, cache *renderCache, w http.ResponseWriter, r *http.Request) {
+	group := r.PathValue("group")
+	name := r.PathValue("name")
+	form := r.URL.Query()
+
+	attrs, name, err := findServedMap(cfg.Maps[group], name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(name) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	format := s.ToLower(s.TrimPrefix(filepath.Ext(name), "."))
+	if len(form.Get("format")) > 0 {
+		format = s.ToLower(form.Get("format"))
+	}
+	if format == "htm" {
+		format = "html"
+	}
+	if format != "png" && format != "svg" && format != "html" {
+		http.Error(w, fmt.Sprintf("unknown format '%s'", format), http.StatusBadRequest)
+		return
+	}
+
+	if size := form.Get("size"); len(size) > 0 {
+		if err := checkServeSize(attrs, size); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		attrs.OutputSize = size
+	}
+
+	// extra db_where conditions can only come from the configured filters
+	filters := form["where"]
+	slices.Sort(filters)
+	filters = slices.Compact(filters)
+	var conditions []query.Condition
+	for _, filter := range filters {
+		cond, ok := cfg.Server.Filters[filter]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown filter '%s'", filter), http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, query.Condition{SQL: cond, Params: queryParams(cfg, attrs)})
+	}
+	if len(conditions) > 0 && len(cfg.DbParam["type"]) == 0 {
+		http.Error(w, "filters need a database", http.StatusBadRequest)
+		return
+	}
+
+	// the global tallies are only read for maps that use them
+	var (
+		global *regionData
+		in     *mapInputs
+	)
+	if usesGlobalData(cfg, attrs, conditions...) {
+		global, err = globalData(cfg)
+	}
+	if err == nil {
+		var (
+			parents map[string]string
+			mapdata map[string]float64
+		)
+		parents, mapdata, err = mapData(cfg, group, attrs, global, conditions...)
+		if err == nil {
+			in, err = loadMapInputs(cfg, group, attrs, parents, mapdata)
+		}
+	}
+	if err != nil {
+		log.Errorf("%s: %v", r.URL, err)
+		http.Error(w, "can't read data", http.StatusInternalServerError)
+		return
+	}
+
+	dataKey := s.Join([]string{group, attrs.OutputFile, s.Join(filters, ",")}, "|")
+	key := s.Join([]string{dataKey, format, attrs.OutputSize}, "|")
+	fingerprint := dataFingerprint(in)
+
+	cached, ok := cache.get(key, fingerprint)
+	if !ok {
+		log.Debugf("render %s", key)
+		cached, err = renderResponse(cfg, group, attrs, in, format)
+		if err != nil {
+			log.Errorf("%s: %v", r.URL, err)
+			http.Error(w, "can't render map", http.StatusInternalServerError)
+			return
+		}
+		cached.key, cached.dataKey, cached.fingerprint = key, dataKey, fingerprint
+		cache.put(cached)
+	}
+
+	w.Header().Set("Content-Type", cached.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(cached.body)))
+	w.Write(cached.body)
+}
+
+// a requested size must be a geometry that makes an image no bigger than
+// maxServeSide pixels a side, or than the map's own outsize if that's bigger
+func checkServeSize(attrs config.MapSet, size string) error {
+	svgData, err := os.ReadFile(filepath.FromSlash(attrs.InputFile))
+	if err != nil {
+		log.Errorf("%s: %v", attrs.InputFile, err)
+		return fmt.Errorf("can't read map")
+	}
+	width, height, err := raster.Size(svgData, size)
+	if err != nil {
+		return err
+	}
+	maxWidth, maxHeight := maxServeSide, maxServeSide
+	if len(attrs.OutputSize) > 0 {
+		if w, h, err := raster.Size(svgData, attrs.OutputSize); err == nil {
+			maxWidth, maxHeight = max(maxWidth, w), max(maxHeight, h)
+		}
+	}
+	if width > maxWidth || height > maxHeight {
+		return fmt.Errorf("size '%s' is %dx%d, more than %dx%d", size, width, height, maxWidth, maxHeight)
+	}
+	return nil
+}
+
+func renderResponse(cfg *config.Config, maptype string, attrs config.MapSet, in *mapInputs, format string) (cachedMap, error) {
+	out, err := renderMap(cfg, maptype, attrs, in, format)
+	if err != nil {
+		return cachedMap{}, err
+	}
+
+	switch {
+	case out.img != nil:
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, out.img); err != nil {
+			return cachedMap{}, err
+		}
+		return cachedMap{contentType: "image/png", body: buf.Bytes()}, nil
+	case out.html != nil:
+		return cachedMap{contentType: "text/html; charset=utf-8", body: out.html}, nil
+	}
+
+	body, err := out.svg.GetXml()
+	if err != nil {
+		return cachedMap{}, err
+	}
+	return cachedMap{contentType: "image/svg+xml", body: body}, nil
+}
+
+// a hash of everything a map is drawn from, which changes whenever any of
+// it does
+func dataFingerprint(in *mapInputs) string {
+	h := sha256.New()
+	hashMap(h, in.parents)
+	hashMap(h, in.data)
+	hashMap(h, in.aliases)
+	hashMap(h, in.denominators)
+	hashMap(h, in.baseline)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashMap[V any](h hash.Hash, m map[string]V) {
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		fmt.Fprintf(h, "%s\t%v\n", k, m[k])
+	}
+	h.Write([]byte{0})
+}
+
+// the map a request's name is for: the one whose outfile has that name, or
+// else the one whose outfile has that name with another extension (which
+// is added to the name). An empty name if there's no such map, and an error
+// if there's more than one.
+func findServedMap(mapset []config.MapSet, name string) (config.MapSet, string, error) {
+	for _, m := range mapset {
+		if filepath.Base(filepath.FromSlash(m.OutputFile)) == name {
+			return m, name, nil
+		}
+	}
+
+	base := s.TrimSuffix(name, filepath.Ext(name))
+	var matches []config.MapSet
+	for _, m := range mapset {
+		outfile := filepath.Base(filepath.FromSlash(m.OutputFile))
+		if s.TrimSuffix(outfile, filepath.Ext(outfile)) == base {
+			matches = append(matches, m)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return config.MapSet{}, "", nil
+	case 1:
+		if len(filepath.Ext(name)) == 0 {
+			outfile := matches[0].OutputFile
+			name += filepath.Ext(outfile)
+		}
+		return matches[0], name, nil
+	}
+	return config.MapSet{}, "", fmt.Errorf("'%s' could be any of %d maps", name, len(matches))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	s "strings"
+	"sync"
+	"testing"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+)
+
+func serveRequest(cfg *config.Config, cache *renderCache, target string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /maps/{group}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		serveMap(cfg, cache, w, r)
+	})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	return rec
+}
+
+// the same map, rendered again (and at the same time) after its data
+// changes, has the new tallies in its annotation, and the configuration
+// keeps its placeholders
+func TestServeRendersTwice(t *testing.T) {
+	cfg := fixtureConfig(t)
+	cache := newRenderCache()
+	lines := slices.Clone(cfg.Maps["states"][0].LegendAnnotate.Annotation)
+
+	for _, tc := range []struct {
+		data, want string
+	}{
+		{"", "55 events in 6 states"},
+		{"state,county,tally\nMN,Hennepin,3\nWI,Dane,4\n", "7 events in 2 states"},
+	} {
+		if len(tc.data) > 0 {
+			if err := os.WriteFile("data.csv", []byte(tc.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var wg sync.WaitGroup
+		for i := range 4 {
+			wg.Go(func() {
+				// a size or format each, so they're rendered rather than
+				// cached
+				target := fmt.Sprintf("/maps/states/states.svg?size=%dx200", 300+i)
+				rec := serveRequest(cfg, cache, target)
+				if rec.Code != http.StatusOK {
+					t.Errorf("%s: %d %s", target, rec.Code, rec.Body)
+				} else if !s.Contains(rec.Body.String(), tc.want) {
+					t.Errorf("%s: no '%s' in the annotation", target, tc.want)
+				}
+			})
+		}
+		wg.Wait()
+	}
+
+	if got := cfg.Maps["states"][0].LegendAnnotate.Annotation; !slices.Equal(got, lines) {
+		t.Errorf("annotation changed from %q to %q", lines, got)
+	}
+}
+
+func TestServeSize(t *testing.T) {
+	cfg := fixtureConfig(t)
+	cache := newRenderCache()
+	for size, want := range map[string]int{
+		"600x400":       http.StatusOK,
+		"4096x":         http.StatusOK,
+		"4097x":         http.StatusBadRequest,
+		"100000x100000": http.StatusBadRequest,
+		"5000%":         http.StatusBadRequest,
+		"nonsense":      http.StatusBadRequest,
+	} {
+		if rec := serveRequest(cfg, cache, "/maps/states/states.png?size="+url.QueryEscape(size)); rec.Code != want {
+			t.Errorf("size %s: got %d, want %d (%s)", size, rec.Code, want, s.TrimSpace(rec.Body.String()))
+		}
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	cache := newRenderCache()
+	for i := range maxCachedMaps + 10 {
+		cache.put(cachedMap{key: fmt.Sprintf("m%d|png", i), dataKey: fmt.Sprintf("m%d", i), fingerprint: "a"})
+	}
+	if n := len(cache.entries); n != maxCachedMaps || cache.lru.Len() != maxCachedMaps {
+		t.Errorf("%d entries (%d in the list), want %d", n, cache.lru.Len(), maxCachedMaps)
+	}
+	if _, ok := cache.get("m0|png", "a"); ok {
+		t.Error("the least recently used map is still cached")
+	}
+	if _, ok := cache.get("m20|png", "b"); ok {
+		t.Error("a map is cached for data it wasn't made from")
+	}
+
+	// new data for one size of a map drops its other sizes
+	cache.put(cachedMap{key: "m20|svg", dataKey: "m20", fingerprint: "b"})
+	if _, ok := cache.get("m20|png", "a"); ok {
+		t.Error("a map made from old data is still cached")
+	}
+	if _, ok := cache.get("m20|svg", "b"); !ok {
+		t.Error("the new map isn't cached")
+	}
+	if _, ok := cache.get("m21|png", "a"); !ok {
+		t.Error("another map was dropped")
+	}
+}
+
+func TestFindServedMap(t *testing.T) {
+	cfg := fixtureConfig(t)
+	for _, tc := range []struct {
+		request, wantMap, wantName string
+		ambiguous                  bool
+	}{
+		{"states.png", "states-png", "states.png", false},
+		{"states.svg", "states-svg", "states.svg", false},
+		{"states-gradient", "states-gradient", "states-gradient.png", false},
+		{"states-gradient.html", "states-gradient", "states-gradient.html", false},
+		{"states", "", "", true},
+		{"states.html", "", "", true},
+		{"nowhere.png", "", "", false},
+	} {
+		m, name, err := findServedMap(cfg.Maps["states"], tc.request)
+		if tc.ambiguous != (err != nil) {
+			t.Errorf("%s: error %v", tc.request, err)
+		}
+		if m.Name != tc.wantMap || name != tc.wantName {
+			t.Errorf("%s: got map '%s' as %s, want '%s' as %s", tc.request, m.Name, name, tc.wantMap, tc.wantName)
+		}
+	}
+}
+
+// the cached map is only used while nothing it was drawn from has changed
+func TestDataFingerprint(t *testing.T) {
+	base := func() *mapInputs {
+		return &mapInputs{
+			data:         map[string]float64{"MN": 3, "WI": 4},
+			aliases:      map[string]string{"Minn": "MN"},
+			denominators: map[string]float64{"MN": 5.7, "WI": 5.9},
+			baseline:     map[string]float64{"MN": 1},
+		}
+	}
+	fingerprint := dataFingerprint(base())
+	if again := dataFingerprint(base()); again != fingerprint {
+		t.Error("the same inputs have different fingerprints")
+	}
+	for what, change := range map[string]func(*mapInputs){
+		"data":         func(in *mapInputs) { in.data["WI"] = 5 },
+		"parents":      func(in *mapInputs) { in.parents = map[string]string{"MN Hennepin": "MN"} },
+		"aliases":      func(in *mapInputs) { in.aliases["Wisc"] = "WI" },
+		"denominators": func(in *mapInputs) { in.denominators["MN"] = 5.8 },
+		"baseline":     func(in *mapInputs) { in.baseline = nil },
+	} {
+		in := base()
+		change(in)
+		if dataFingerprint(in) == fingerprint {
+			t.Errorf("changing the %s leaves the fingerprint the same", what)
+		}
+	}
+}
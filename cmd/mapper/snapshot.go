@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	s "strings"
+	"time"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// the snapshot file format; bump it when the format changes
+const snapshotVersion = 1
+
+const snapshotSuffix = ".snapshot.json"
+
+// the data one map was drawn with: the tallies after db_where, data files,
+// inline_data and pruning, and the denominators they were normalized by (if
+// they were), so the map can be drawn again without the database
+type snapshot struct {
+	Version      int                `json:"version"`
+	Created      time.Time          `json:"created"`
+	MapType      string             `json:"map_type"`
+	InputFile    string             `json:"infile"`
+	OutputFile   string             `json:"outfile"`
+	Data         map[string]float64 `json:"data"`
+	Denominators map[string]float64 `json:"denominators,omitempty"`
+}
+
+func snapshotEnabled(cfg *config.Config, attrs config.MapSet) bool {
+	switch s.ToLower(cfg.General["snapshot"]) {
+	case "yes", "true":
+		return true
+	}
+	return attrs.Snapshot
+}
+
+// write a snapshot next to the map's output file, named for the output file
+// and the time, e.g. usmap-20240601T120000Z.snapshot.json for usmap.png
+func writeSnapshot(maptype string, attrs config.MapSet, rendered *renderedMap, created time.Time) (string, error) {
+	created = created.UTC().Truncate(time.Second)
+	snap := snapshot{
+		Version:      snapshotVersion,
+		Created:      created,
+		MapType:      maptype,
+		InputFile:    filepath.ToSlash(attrs.InputFile),
+		OutputFile:   filepath.ToSlash(attrs.OutputFile),
+		Data:         rendered.data,
+		Denominators: rendered.denominators,
+	}
+	out, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	base := s.TrimSuffix(attrs.OutputFile, filepath.Ext(attrs.OutputFile))
+	file := base + "-" + created.Format("20060102T150405Z") + snapshotSuffix
+	return file, os.WriteFile(file, append(out, '\n'), 0644)
+}
+
+func readSnapshot(file string) (*snapshot, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	if snap.Version == 0 {
+		return nil, fmt.Errorf("not a snapshot file")
+	} else if snap.Version > snapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d is newer than this mapper (%d)", snap.Version, snapshotVersion)
+	}
+	return &snap, nil
+}
+
+// draw a map again from a snapshot, with the settings of the configured map
+// that has the same outfile. The result is written next to the snapshot,
+// named like it, e.g. usmap-20240601T120000Z.png.
+func renderSnapshot(cfg *config.Config, file string) error {
+	snap, err := readSnapshot(file)
+	if err != nil {
+		return err
+	}
+
+	var attrs config.MapSet
+	found := false
+	for _, m := range cfg.Maps[snap.MapType] {
+		if filepath.ToSlash(m.OutputFile) == snap.OutputFile {
+			attrs = m
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("no %s map with outfile '%s' in the configuration", snap.MapType, snap.OutputFile)
+	}
+
+	attrs.InputFile = snap.InputFile
+	attrs.OutputFile = s.TrimSuffix(file, snapshotSuffix) + filepath.Ext(snap.OutputFile)
+	// the snapshot has everything the map shows; there's nothing to compare
+	// it with
+	attrs.Delta = config.DeltaParams{}
+	// and its tallies already have the SVG's ids
+	attrs.Aliases = "-"
+
+	// %T% is when the snapshot was taken
+	timefmt := cfg.LADefaults.AnnotationTimeFmt
+	if len(attrs.LegendAnnotate.AnnotationTimeFmt) > 0 {
+		timefmt = attrs.LegendAnnotate.AnnotationTimeFmt
+	}
+	lines := make([]string, len(attrs.LegendAnnotate.Annotation))
+	for i, line := range attrs.LegendAnnotate.Annotation {
+		lines[i] = s.ReplaceAll(line, "%T%", snap.Created.Local().Format(timefmt))
+	}
+	attrs.LegendAnnotate.Annotation = lines
+
+	// a normalized map is normalized by the denominators it had, rather than
+	// by reading or querying them again
+	if normalizing(normalizeParams(cfg, attrs)) && snap.Denominators == nil {
+		return fmt.Errorf("the map is normalized, but the snapshot has no denominators")
+	}
+	in := &mapInputs{data: snap.Data, denominators: snap.Denominators}
+	out, err := renderMap(cfg, snap.MapType, attrs, in, outputFormat(attrs.OutputFile))
+	if err != nil {
+		return err
+	}
+	if err := writeMap(attrs.OutputFile, out); err != nil {
+		return err
+	}
+	log.Infof("%s: drawn from %s", attrs.OutputFile, file)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	s "strings"
+	"testing"
+	"time"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+)
+
+// a normalized map drawn again from its snapshot, once its denominators are
+// gone, comes out the same
+func TestSnapshotNormalized(t *testing.T) {
+	cfg := fixtureConfig(t)
+	if err := os.WriteFile("pop.csv", []byte("state,pop\nMN,5.7\nWI,5.9\nIA,3.2\nND,0.8\nIL,12.5\nMI,10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Normalize = config.NormalizeParams{DenominatorFile: "pop.csv"}
+	attrs := cfg.Maps["states"][0]
+
+	global, err := globalData(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parents, mapdata, err := mapData(cfg, "states", attrs, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := loadMapInputs(cfg, "states", attrs, parents, mapdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := renderMap(cfg, "states", attrs, in, "svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join("out", "drawn.svg")
+	if err := writeMap(want, out); err != nil {
+		t.Fatal(err)
+	}
+	snapfile, err := writeSnapshot("states", attrs, out, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove("pop.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := renderSnapshot(cfg, snapfile); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(s.TrimSuffix(snapfile, snapshotSuffix) + ".svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantData, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, wantData) {
+		t.Error("the map drawn from the snapshot differs from the original")
+	}
+}
@@ -3,14 +3,18 @@ module github.com/jeff-blank/mapper
 go 1.26.2
 
 require (
+	github.com/go-sql-driver/mysql v1.9.3
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/jeff-blank/svgxml v0.0.8
 	github.com/lib/pq v1.12.3
+	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/sirupsen/logrus v1.10.1
 	go.yaml.in/yaml/v4 v4.0.0-rc.6
+	golang.org/x/image v0.45.0
 )
 
 require (
-	golang.org/x/image v0.45.0 // indirect
+	filippo.io/edwards25519 v1.1.0 // indirect
 	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
 )
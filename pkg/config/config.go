@@ -1,8 +1,13 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	s "strings"
 
 	log "github.com/sirupsen/logrus"
 	"go.yaml.in/yaml/v4"
@@ -21,6 +26,7 @@ type LegendAnnotateParams struct {
 	LegendCellWidth     int      `yaml:"legend_cell_width"`
 	LegendCellHeight    int      `yaml:"legend_cell_height"`
 	LegendCellGap       int      `yaml:"legend_cell_gap"`
+	LegendDecimals      []int    `yaml:"legend_decimals"`
 	AnnotationFontFile  string   `yaml:"annotation_fontfile"`
 	AnnotationFontSize  float64  `yaml:"annotation_fontsize"`
 	AnnotationSpacing   []int    `yaml:"annotation_spacing"`
@@ -29,45 +35,294 @@ type LegendAnnotateParams struct {
 	Annotation          []string `yaml:"annotation"`
 	AnnotationX         int      `yaml:"annotation_x"`
 	AnnotationY         int      `yaml:"annotation_y"`
+	AnnotationDecimals  []int    `yaml:"annotation_decimals"`
+	Label               string   `yaml:"label"`
+	LabelFontFile       string   `yaml:"label_fontfile"`
+	LabelFontSize       float64  `yaml:"label_fontsize"`
+	LabelTextStyle      string   `yaml:"label_text_style"`
+	LabelColour         string   `yaml:"label_colour"`
+	LabelHaloColour     string   `yaml:"label_halo_colour"`
+	LabelHaloWidth      []int    `yaml:"label_halo_width"`
+	LabelMinArea        int      `yaml:"label_min_area"`
+}
+
+type DataFileParams struct {
+	DataFile      string `yaml:"data_file"`
+	DataFormat    string `yaml:"data_format"`
+	DataHeader    string `yaml:"data_header"`
+	DataDelimiter string `yaml:"data_delimiter"`
+	StateColumn   string `yaml:"data_state_column"`
+	CountyColumn  string `yaml:"data_county_column"`
+	TallyColumn   string `yaml:"data_tally_column"`
+}
+
+type Classification struct {
+	Method      string   `yaml:"method"`
+	Classes     int      `yaml:"classes"`
+	Palette     []string `yaml:"palette"`
+	PaletteName string   `yaml:"palette_name"`
+}
+
+type PaletteParams struct {
+	Name     string    `yaml:"name"`
+	Mincount []float64 `yaml:"mincount"`
+}
+
+type AnimationParams struct {
+	DateColumn string `yaml:"date_column"`
+	Step       string `yaml:"step"`
+	Start      string `yaml:"start"`
+	End        string `yaml:"end"`
+	DateFormat string `yaml:"date_format"`
+	FrameDelay int    `yaml:"frame_delay"`
+	Hold       *int   `yaml:"hold"` // nil for the default
+}
+
+type NormalizeParams struct {
+	DenominatorFile   string  `yaml:"denominator_file"`
+	DenominatorColumn string  `yaml:"denominator_column"`
+	DenominatorQuery  string  `yaml:"denominator_query"`
+	Multiplier        float64 `yaml:"multiplier"`
+}
+
+type DeltaParams struct {
+	Baseline       string `yaml:"baseline"`
+	UpdateBaseline bool   `yaml:"update_baseline"`
+	Since          string `yaml:"since"`
+	DateColumn     string `yaml:"date_column"`
+	Colour         string `yaml:"colour"`
+	Outline        string `yaml:"outline"`
+	OutlineWidth   int    `yaml:"outline_width"`
+}
+
+// one level of the region hierarchy. A region's id comes from its value in
+// the level's column, by the join rule: %id% is the value and %parent% the id
+// of the region it's in, and spaces become underscores. Rollup is how a
+// region's tally is made from the rows within it: sum, max or distinct.
+type LevelParams struct {
+	Name       string `yaml:"name"`
+	Column     string `yaml:"column"`
+	DataColumn string `yaml:"data_column"`
+	Join       string `yaml:"join"`
+	Rollup     string `yaml:"rollup"`
+}
+
+type ServerParams struct {
+	Listen  string            `yaml:"listen"`
+	Filters map[string]string `yaml:"filters"`
+}
+
+// everything that decides how tallies are coloured; set globally, and
+// optionally overridden per map group and per map
+type ColourParams struct {
+	Colours     map[string]string `yaml:"colours"`
+	Palette     PaletteParams     `yaml:"palette"`
+	ColourMode  string            `yaml:"colour_mode"`
+	ColourSpace string            `yaml:"colour_space"`
+	Classify    Classification    `yaml:"classification"`
 }
 
 type MapSet struct {
+	Name             string               `yaml:"name"`
 	InputFile        string               `yaml:"infile"`
 	OutputFile       string               `yaml:"outfile"`
 	OutputSize       string               `yaml:"outsize"`
 	RegionAdjustment int                  `yaml:"regions_adjust"`
 	LegendAnnotate   LegendAnnotateParams `yaml:",inline"`
-	InlineData       map[string]int       `yaml:"inline_data"`
+	InlineData       map[string]float64   `yaml:"inline_data"`
+	DataSource       DataFileParams       `yaml:",inline"`
 	DbWhere          string               `yaml:"db_where"`
+	Params           map[string]string    `yaml:"params"`
+	RegionUrl        string               `yaml:"region_url"`
+	Level            string               `yaml:"level"`
+	Aliases          string               `yaml:"aliases"`
+	Animation        AnimationParams      `yaml:"animation"`
+	Delta            DeltaParams          `yaml:"delta"`
+	Normalize        NormalizeParams      `yaml:"normalize"`
+	Snapshot         bool                 `yaml:"snapshot"`
 	IgnoreMissing    map[string]bool      `yaml:"ignore_missing"`
+
+	ColourParams `yaml:",inline"`
 }
 
 type Config struct {
 	General       map[string]string
-	Colours       map[string]string
-	LADefaults    LegendAnnotateParams `yaml:"legend_annotation_defaults"`
-	Maps          map[string][]MapSet  `yaml:"maps"`
-	DbParam       map[string]string    `yaml:"database"`
-	SmallGlobId   map[string]int       `yaml:"small_glob_id"`
-	SmallGlobSize map[string]int       `yaml:"small_glob_size"`
-	LargeGlobId   map[string]int       `yaml:"large_glob_id"`
-	LargeGlobSize map[string]int       `yaml:"large_glob_size"`
-	NoGlobId      map[string]int       `yaml:"no_glob_id"`
-	NoGlobIdDb    int                  `yaml:"no_glob_id_db"`
+	MapGroups     map[string]ColourParams `yaml:"map_groups"`
+	LADefaults    LegendAnnotateParams    `yaml:"legend_annotation_defaults"`
+	DataSource    DataFileParams          `yaml:"data"`
+	Normalize     NormalizeParams         `yaml:"normalize"`
+	Levels        []LevelParams           `yaml:"levels"`
+	Maps          map[string][]MapSet     `yaml:"maps"`
+	DbParam       map[string]string       `yaml:"database"`
+	Params        map[string]string       `yaml:"params"`
+	Server        ServerParams            `yaml:"server"`
+	SmallGlobId   map[string]int          `yaml:"small_glob_id"`
+	SmallGlobSize map[string]int          `yaml:"small_glob_size"`
+	LargeGlobId   map[string]int          `yaml:"large_glob_id"`
+	LargeGlobSize map[string]int          `yaml:"large_glob_size"`
+	NoGlobId      map[string]int          `yaml:"no_glob_id"`
+	NoGlobIdDb    int                     `yaml:"no_glob_id_db"`
+
+	ColourParams `yaml:",inline"`
+
+	// parameter values given on the command line, which override those in
+	// the file
+	ParamOverrides map[string]string `yaml:"-"`
+
+	// the parsed file, for finding the lines that problems are on
+	root *yaml.Node
 }
 
+// read and check the configuration, exiting if there's anything wrong with
+// it; files that can't be read are only warned about, and left to fail the
+// maps that use them
 func New(configFile string) *Config {
-	config := &Config{}
+	config, problems, err := Load(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	invalid := false
+	for _, p := range problems {
+		if p.File {
+			log.Warnf("%s:%s", configFile, p)
+		} else {
+			log.Errorf("%s:%s", configFile, p)
+			invalid = true
+		}
+	}
+	if invalid {
+		log.Fatalf("%s: invalid configuration", configFile)
+	}
+	log.Debugf("config.New(): defaults=%+v", config.LADefaults)
+
+	return config
+}
+
+// read the configuration, returning everything that's wrong with it; the
+// error is for a file that can't be read or parsed at all
+func Load(configFile string) (*Config, []Problem, error) {
+	config := &Config{root: &yaml.Node{}}
+	var problems []Problem
+	add := func(path, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Line: config.line(path), Message: fmt.Sprintf(format, args...)})
+	}
 
 	yamlcfg, err := os.ReadFile(filepath.FromSlash(configFile))
 	if err != nil {
-		log.Fatalf("read config file '%s': %v", configFile, err)
+		return nil, nil, fmt.Errorf("read config file '%s': %v", configFile, err)
 	}
 
-	if err := yaml.Unmarshal(yamlcfg, &config); err != nil {
-		log.Fatal("yaml.Unmarshal(): ", err)
+	if err := yaml.Unmarshal(yamlcfg, config.root); err != nil {
+		return nil, nil, fmt.Errorf("yaml.Unmarshal(): %v", err)
+	}
+	if err := config.root.Decode(config); err != nil {
+		var loadErrors *yaml.LoadErrors
+		if !errors.As(err, &loadErrors) {
+			return nil, nil, fmt.Errorf("yaml.Unmarshal(): %v", err)
+		}
+		for _, e := range loadErrors.Errors {
+			problems = append(problems, Problem{Path: config.pathAt(e.Mark.Line), Line: e.Mark.Line, Message: e.Message})
+		}
 	}
-	log.Debugf("config.New(): defaults=%+v", config.LADefaults)
 
-	return config
+	config.expandPalettes("", add)
+	for group, params := range config.MapGroups {
+		params.expandPalettes(joinPath("map_groups", group), add)
+		config.MapGroups[group] = params
+	}
+	for group, mapset := range config.Maps {
+		for i := range mapset {
+			mapset[i].expandPalettes(fmt.Sprintf("%s[%d]", joinPath("maps", group), i), add)
+		}
+	}
+
+	problems = append(problems, config.Validate()...)
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	return config, problems, nil
+}
+
+// the colour settings for one map: the global ones, overridden by its
+// group's and then its own. Colours (or a palette) set at one level replace
+// any colours and classification from the levels above it; a classification
+// method replaces the classification and takes precedence over colours.
+func (config *Config) MapColours(group string, mapset MapSet) ColourParams {
+	params := config.ColourParams
+	for _, override := range []ColourParams{config.MapGroups[group], mapset.ColourParams} {
+		if len(override.Colours) > 0 {
+			params.Colours = override.Colours
+			params.Classify = Classification{}
+		}
+		if len(override.Classify.Method) > 0 {
+			params.Classify = override.Classify
+		}
+		if len(override.ColourMode) > 0 {
+			params.ColourMode = override.ColourMode
+		}
+		if len(override.ColourSpace) > 0 {
+			params.ColourSpace = override.ColourSpace
+		}
+	}
+	return params
+}
+
+// the values of the named parameters (:name) in a map's database
+// conditions and queries: the global params, overridden by the map's own and
+// then by those given on the command line
+func (config *Config) QueryParams(mapset MapSet) map[string]string {
+	params := make(map[string]string)
+	for _, p := range []map[string]string{config.Params, mapset.Params, config.ParamOverrides} {
+		for k, v := range p {
+			params[k] = v
+		}
+	}
+	return params
+}
+
+// the region hierarchy, coarsest level first, with defaults filled in.
+// Without a 'levels' section, it's states and counties, from the database's
+// state_column and county_column and the data files' state and county
+// columns.
+func (config *Config) Hierarchy() []LevelParams {
+	if len(config.Levels) == 0 {
+		return []LevelParams{
+			{Name: "states", Column: config.DbParam["state_column"], DataColumn: "state", Join: "%id%", Rollup: "sum"},
+			{Name: "counties", Column: config.DbParam["county_column"], DataColumn: "county", Join: "%parent%_%id%", Rollup: "sum"},
+		}
+	}
+
+	levels := slices.Clone(config.Levels)
+	for i := range levels {
+		if len(levels[i].DataColumn) == 0 {
+			levels[i].DataColumn = levels[i].Name
+		}
+		if len(levels[i].Join) == 0 {
+			levels[i].Join = "%parent%_%id%"
+			if i == 0 {
+				levels[i].Join = "%id%"
+			}
+		}
+		levels[i].Rollup = s.ToLower(levels[i].Rollup)
+		if len(levels[i].Rollup) == 0 {
+			levels[i].Rollup = "sum"
+		}
+	}
+	return levels
+}
+
+// the hierarchy level a map shows: the one named by its 'level', or else by
+// its group, or else the deepest one
+func (config *Config) MapLevel(group string, mapset MapSet) int {
+	levels := config.Hierarchy()
+	name := group
+	if len(mapset.Level) > 0 {
+		name = mapset.Level
+	}
+	for i, level := range levels {
+		if level.Name == name {
+			return i
+		}
+	}
+	return len(levels) - 1
 }
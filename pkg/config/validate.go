@@ -0,0 +1,605 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	s "strings"
+	"time"
+
+	"github.com/jeff-blank/mapper/pkg/query"
+	"github.com/jeff-blank/mapper/pkg/raster"
+	"go.yaml.in/yaml/v4"
+)
+
+// Problem is something wrong with the configuration, and where it is. File
+// problems are files (input SVGs, fonts, data files and the like) that can't
+// be read; they only matter to the maps that use them.
+type Problem struct {
+	Path    string
+	Line    int
+	Message string
+	File    bool
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%d: %s: %s", p.Line, p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// keys for the sections that are plain maps rather than structs
+var knownMapKeys = map[string][]string{
+	"general": {"rasterizer", "imagemagick_convert", "region_url", "snapshot"},
+	"database": {"type", "dsn", "name", "host", "connect_opts", "username", "password",
+		"state_column", "county_column", "tally_column", "tables", "where", "group_by"},
+}
+
+// Validate checks the configuration for unknown keys, bad values, missing
+// per-map settings and unreadable files, returning every problem found
+// (sorted by line)
+func (config *Config) Validate() []Problem {
+	var problems []Problem
+	add := func(path, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Line: config.line(path), Message: fmt.Sprintf(format, args...)})
+	}
+	addFile := func(path string, err error) {
+		problems = append(problems, Problem{Path: path, Line: config.line(path), Message: err.Error(), File: true})
+	}
+
+	if config.root != nil {
+		problems = append(problems, unknownKeys(config.root, reflect.TypeOf(*config), "")...)
+	}
+
+	if config.General["rasterizer"] != "" && config.General["rasterizer"] != "builtin" && config.General["rasterizer"] != "imagemagick" {
+		add("general.rasterizer", "must be 'imagemagick' or 'builtin'")
+	}
+	switch s.ToLower(config.General["snapshot"]) {
+	case "", "yes", "no", "true", "false":
+	default:
+		add("general.snapshot", "must be 'yes' or 'no'")
+	}
+
+	validateColours(config.ColourParams, "", add)
+	for group, params := range config.MapGroups {
+		validateColours(params, joinPath("map_groups", group), add)
+	}
+	validateLegendAnnotate(config.LADefaults, "legend_annotation_defaults", add, addFile)
+	validateDataFile(config.DataSource, "data", add, addFile)
+	validateNormalize(config, config.Normalize, "normalize", add, addFile)
+	validateLevels(config, add)
+	validateQueries(config, add)
+
+	named := make(map[string]int)
+	for _, mapset := range config.Maps {
+		for _, m := range mapset {
+			if len(m.Name) > 0 {
+				named[m.Name]++
+			}
+		}
+	}
+
+	for group, mapset := range config.Maps {
+		for i, m := range mapset {
+			path := fmt.Sprintf("%s[%d]", joinPath("maps", group), i)
+			if named[m.Name] > 1 {
+				add(joinPath(path, "name"), "'%s' is the name of more than one map", m.Name)
+			}
+			if len(m.InputFile) == 0 {
+				add(path, "missing 'infile'")
+			} else if err := readable(m.InputFile); err != nil {
+				addFile(joinPath(path, "infile"), err)
+			} else if len(m.OutputSize) > 0 && config.General["rasterizer"] == "builtin" {
+				// ImageMagick has its own (larger) idea of a geometry
+				validateOutsize(m, path, add)
+			}
+			if len(m.OutputFile) == 0 {
+				add(path, "missing 'outfile'")
+			} else if len(m.OutputSize) == 0 && config.General["rasterizer"] != "builtin" {
+				// the builtin rasterizer uses the SVG's own size
+				switch s.ToLower(filepath.Ext(m.OutputFile)) {
+				case ".svg", ".html", ".htm":
+				default:
+					add(path, "missing 'outsize'")
+				}
+			}
+			if len(m.Level) > 0 || len(config.Levels) > 0 {
+				level := group
+				if len(m.Level) > 0 {
+					level = m.Level
+				}
+				if !slices.ContainsFunc(config.Hierarchy(), func(l LevelParams) bool { return l.Name == level }) {
+					add(joinPath(path, "level"), "no level named '%s'", level)
+				}
+			}
+			if len(m.Aliases) > 0 && m.Aliases != "-" {
+				switch s.ToLower(filepath.Ext(m.Aliases)) {
+				case ".csv", ".yml", ".yaml":
+					if err := readable(m.Aliases); err != nil {
+						addFile(joinPath(path, "aliases"), err)
+					}
+				default:
+					add(joinPath(path, "aliases"), "must be a .csv, .yml or .yaml file")
+				}
+			}
+			validateColours(m.ColourParams, path, add)
+			validateLegendAnnotate(m.LegendAnnotate, path, add, addFile)
+			validateDataFile(m.DataSource, path, add, addFile)
+			validateNormalize(config, m.Normalize, joinPath(path, "normalize"), add, addFile)
+			if err := query.Check(m.DbWhere); err != nil {
+				add(joinPath(path, "db_where"), "%v", err)
+			}
+			if len(m.Animation.DateColumn) > 0 {
+				validateAnimation(config, m, joinPath(path, "animation"), add)
+			}
+			if len(m.Delta.Baseline) > 0 || len(m.Delta.Since) > 0 {
+				validateDelta(config, m, joinPath(path, "delta"), add)
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	return problems
+}
+
+func validateColours(params ColourParams, path string, add func(string, string, ...any)) {
+	for k, v := range params.Colours {
+		if _, err := strconv.ParseInt(k, 0, 64); err != nil {
+			if _, err := strconv.ParseFloat(k, 64); err != nil {
+				add(joinPath(path, "colours", k), "'%s' is not a number", k)
+			}
+		}
+		if !isHexColour(v) {
+			add(joinPath(path, "colours", k), "colour '%s' is not 6 hex digits", v)
+		}
+	}
+
+	switch s.ToLower(params.ColourMode) {
+	case "", "steps", "gradient":
+	default:
+		add(joinPath(path, "colour_mode"), "must be 'steps' or 'gradient'")
+	}
+	switch s.ToLower(params.ColourSpace) {
+	case "", "rgb", "hsl", "lab":
+	default:
+		add(joinPath(path, "colour_space"), "must be 'rgb', 'hsl' or 'lab'")
+	}
+
+	switch s.ToLower(params.Classify.Method) {
+	case "", "quantile", "equal", "equal_interval", "geometric", "log", "jenks":
+	default:
+		add(joinPath(path, "classification", "method"), "unknown method '%s'", params.Classify.Method)
+	}
+	if len(params.Classify.Method) > 0 && len(params.Classify.Palette) == 0 && len(params.Classify.PaletteName) == 0 {
+		add(joinPath(path, "classification"), "missing 'palette' or 'palette_name'")
+	}
+	for i, v := range params.Classify.Palette {
+		if !isHexColour(v) {
+			add(fmt.Sprintf("%s[%d]", joinPath(path, "classification", "palette"), i), "colour '%s' is not 6 hex digits", v)
+		}
+	}
+}
+
+func validateLegendAnnotate(params LegendAnnotateParams, path string, add func(string, string, ...any), addFile func(string, error)) {
+	// gravity is NE, NW, SE or SW, or "-" to place the legend by legend_x
+	// and legend_y
+	if g := params.LegendGravity; len(g) > 0 && g != "-" {
+		if len(g) != 2 || !s.ContainsRune("NnSs", rune(g[0])) || !s.ContainsRune("EeWw", rune(g[1])) {
+			add(joinPath(path, "legend_gravity"), "must be NE, NW, SE, SW or -, not '%s'", g)
+		}
+	}
+	switch params.LegendOrient {
+	case "", "vertical", "horizontal":
+	default:
+		add(joinPath(path, "legend_orient"), "must be 'vertical' or 'horizontal', not '%s'", params.LegendOrient)
+	}
+
+	if len(params.LegendFontFile) > 0 {
+		if err := readable(params.LegendFontFile); err != nil {
+			addFile(joinPath(path, "legend_fontfile"), err)
+		}
+	}
+	if len(params.AnnotationFontFile) > 0 {
+		if err := readable(params.AnnotationFontFile); err != nil {
+			addFile(joinPath(path, "annotation_fontfile"), err)
+		}
+	}
+	if len(params.LabelFontFile) > 0 {
+		if err := readable(params.LabelFontFile); err != nil {
+			addFile(joinPath(path, "label_fontfile"), err)
+		}
+	}
+	for key, colour := range map[string]string{"label_colour": params.LabelColour, "label_halo_colour": params.LabelHaloColour} {
+		if len(colour) > 0 && !isHexColour(colour) {
+			add(joinPath(path, key), "colour '%s' is not 6 hex digits", colour)
+		}
+	}
+	if len(params.LabelHaloWidth) > 0 && params.LabelHaloWidth[0] < 0 {
+		add(joinPath(path, "label_halo_width"), "must not be negative")
+	}
+	for key, decimals := range map[string][]int{"legend_decimals": params.LegendDecimals, "annotation_decimals": params.AnnotationDecimals} {
+		if len(decimals) > 0 && decimals[0] < 0 {
+			add(joinPath(path, key), "must not be negative")
+		}
+	}
+}
+
+// a map's outsize must make an image of a size the builtin rasterizer can
+// draw; an SVG that can't be read (or sized) is left for drawing it to report
+func validateOutsize(m MapSet, path string, add func(string, string, ...any)) {
+	svgData, err := os.ReadFile(filepath.FromSlash(m.InputFile))
+	if err != nil {
+		return
+	}
+	width, height, err := raster.ImageSize(svgData)
+	if err != nil {
+		return
+	}
+	if _, _, err := raster.Geometry(m.OutputSize, width, height); err != nil {
+		add(joinPath(path, "outsize"), "%v", err)
+	}
+}
+
+func validateDataFile(params DataFileParams, path string, add func(string, string, ...any), addFile func(string, error)) {
+	if len(params.DataFile) > 0 && params.DataFile != "-" {
+		if err := readable(params.DataFile); err != nil {
+			addFile(joinPath(path, "data_file"), err)
+		}
+	}
+	switch s.ToLower(params.DataHeader) {
+	case "", "yes", "no", "auto":
+	default:
+		add(joinPath(path, "data_header"), "must be 'yes', 'no' or 'auto'")
+	}
+}
+
+func validateNormalize(config *Config, params NormalizeParams, path string, add func(string, string, ...any), addFile func(string, error)) {
+	if len(params.DenominatorFile) > 0 && len(params.DenominatorQuery) > 0 {
+		add(path, "use either 'denominator_file' or 'denominator_query', not both")
+	}
+	if len(params.DenominatorFile) > 0 {
+		if err := readable(params.DenominatorFile); err != nil {
+			addFile(joinPath(path, "denominator_file"), err)
+		}
+	}
+	if len(params.DenominatorQuery) > 0 && len(config.DbParam["type"]) == 0 {
+		add(joinPath(path, "denominator_query"), "needs a database")
+	}
+	if err := query.Check(params.DenominatorQuery); err != nil {
+		add(joinPath(path, "denominator_query"), "%v", err)
+	}
+	if params.Multiplier < 0 {
+		add(joinPath(path, "multiplier"), "must not be negative")
+	}
+}
+
+func validateLevels(config *Config, add func(string, string, ...any)) {
+	seen := make(map[string]bool)
+	for i, level := range config.Levels {
+		path := fmt.Sprintf("levels[%d]", i)
+		if len(level.Name) == 0 {
+			add(path, "missing 'name'")
+		} else if seen[level.Name] {
+			add(joinPath(path, "name"), "level '%s' is already defined", level.Name)
+		}
+		seen[level.Name] = true
+
+		if len(level.Column) == 0 && len(config.DbParam["type"]) > 0 {
+			add(path, "missing 'column' for the database")
+		}
+		if len(level.Join) > 0 {
+			if !s.Contains(level.Join, "%id%") {
+				add(joinPath(path, "join"), "must contain %%id%%")
+			}
+			if i == 0 && s.Contains(level.Join, "%parent%") {
+				add(joinPath(path, "join"), "the first level has no %%parent%%")
+			}
+		}
+		switch s.ToLower(level.Rollup) {
+		case "", "sum", "max", "distinct":
+		default:
+			add(joinPath(path, "rollup"), "must be 'sum', 'max' or 'distinct'")
+		}
+	}
+}
+
+// the database settings, filters and conditions are pasted into queries as
+// they are, so they mustn't be able to end the statement or comment out the
+// rest of it (whether the database type has a driver is up to the program
+// that connects to it)
+func validateQueries(config *Config, add func(string, string, ...any)) {
+	for _, key := range []string{"state_column", "county_column", "tally_column", "tables", "where", "group_by"} {
+		if err := query.Check(config.DbParam[key]); err != nil {
+			add(joinPath("database", key), "%v", err)
+		}
+	}
+	for i, level := range config.Levels {
+		if err := query.Check(level.Column); err != nil {
+			add(joinPath(fmt.Sprintf("levels[%d]", i), "column"), "%v", err)
+		}
+	}
+	for name, filter := range config.Server.Filters {
+		if err := query.Check(filter); err != nil {
+			add(joinPath("server", "filters", name), "%v", err)
+		}
+	}
+}
+
+func validateAnimation(config *Config, m MapSet, path string, add func(string, string, ...any)) {
+	if err := query.CheckIdent(m.Animation.DateColumn); err != nil {
+		add(joinPath(path, "date_column"), "%v", err)
+	}
+	switch s.ToLower(m.Animation.Step) {
+	case "day", "week", "month", "year":
+	default:
+		add(joinPath(path, "step"), "must be 'day', 'week', 'month' or 'year'")
+	}
+	if m.Animation.Hold != nil && *m.Animation.Hold < 0 {
+		add(joinPath(path, "hold"), "can't be negative")
+	}
+	for key, date := range map[string]string{"start": m.Animation.Start, "end": m.Animation.End} {
+		if _, err := time.Parse(time.DateOnly, date); len(date) > 0 && err != nil {
+			add(joinPath(path, key), "'%s' is not a YYYY-MM-DD date", date)
+		}
+	}
+	switch s.ToLower(filepath.Ext(m.OutputFile)) {
+	case ".gif", ".png":
+	default:
+		add(path, "animations are written to .gif or .png (APNG) files")
+	}
+	if len(config.DbParam["type"]) == 0 || len(m.DataSource.DataFile) > 0 || len(m.InlineData) > 0 {
+		add(path, "animations need their data from the database")
+	}
+}
+
+func validateDelta(config *Config, m MapSet, path string, add func(string, string, ...any)) {
+	delta := m.Delta
+	if len(delta.Baseline) > 0 && len(delta.Since) > 0 {
+		add(path, "use either 'baseline' or 'since', not both")
+	}
+	if delta.UpdateBaseline && len(delta.Baseline) == 0 {
+		add(joinPath(path, "update_baseline"), "needs a 'baseline' file")
+	}
+	if len(delta.Since) > 0 {
+		if _, err := time.Parse(time.DateOnly, delta.Since); err != nil {
+			add(joinPath(path, "since"), "'%s' is not a YYYY-MM-DD date", delta.Since)
+		}
+		if len(delta.DateColumn) == 0 {
+			add(path, "'since' needs a 'date_column'")
+		} else if err := query.CheckIdent(delta.DateColumn); err != nil {
+			add(joinPath(path, "date_column"), "%v", err)
+		}
+		if len(config.DbParam["type"]) == 0 || len(m.DataSource.DataFile) > 0 || len(m.InlineData) > 0 {
+			add(joinPath(path, "since"), "comparing with a date needs the map's data from the database")
+		}
+	}
+	for key, colour := range map[string]string{"colour": delta.Colour, "outline": delta.Outline} {
+		if len(colour) > 0 && !isHexColour(colour) {
+			add(joinPath(path, key), "colour '%s' is not 6 hex digits", colour)
+		}
+	}
+	if delta.OutlineWidth < 0 {
+		add(joinPath(path, "outline_width"), "must not be negative")
+	}
+}
+
+func isHexColour(colour string) bool {
+	colour = s.TrimPrefix(colour, "#")
+	_, err := strconv.ParseUint(colour, 16, 32)
+	return len(colour) == 6 && err == nil
+}
+
+func readable(file string) error {
+	f, err := os.Open(filepath.FromSlash(file))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// report the keys in a mapping node that don't belong to the type it's
+// decoded into, recursing into the values
+func unknownKeys(n *yaml.Node, t reflect.Type, path string) []Problem {
+	var problems []Problem
+
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			break
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			if key == "<<" {
+				continue
+			}
+			field, ok := fields[key]
+			if !ok {
+				problems = append(problems, Problem{Path: joinPath(path, key), Line: n.Content[i].Line, Message: "unknown key"})
+				continue
+			}
+			problems = append(problems, unknownKeys(n.Content[i+1], field, joinPath(path, key))...)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			break
+		}
+		known := knownMapKeys[path]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			if known != nil && !slices.Contains(known, key) {
+				problems = append(problems, Problem{Path: joinPath(path, key), Line: n.Content[i].Line, Message: "unknown key"})
+				continue
+			}
+			problems = append(problems, unknownKeys(n.Content[i+1], t.Elem(), joinPath(path, key))...)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			break
+		}
+		for i, item := range n.Content {
+			problems = append(problems, unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	return problems
+}
+
+// the YAML keys of a struct's fields, including those of inlined structs
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := s.Cut(f.Tag.Get("yaml"), ",")
+		if slices.Contains(s.Split(opts, ","), "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = s.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// the line of the node at a path like "maps.states[0].colours", or of the
+// nearest enclosing node that exists
+func (config *Config) line(path string) int {
+	for len(path) > 0 {
+		if n := config.lookup(path); n != nil {
+			return n.Line
+		}
+		cut := max(s.LastIndex(path, "."), s.LastIndex(path, "["))
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	return 0
+}
+
+func (config *Config) lookup(path string) *yaml.Node {
+	if config.root == nil {
+		return nil
+	}
+	n := config.root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+
+	for _, part := range s.Split(path, ".") {
+		name, index, _ := s.Cut(part, "[")
+		if len(name) > 0 {
+			if n = mappingValue(n, name); n == nil {
+				return nil
+			}
+		}
+		for len(index) > 0 {
+			num, rest, _ := s.Cut(index, "]")
+			i, err := strconv.Atoi(num)
+			if n.Kind == yaml.AliasNode {
+				n = n.Alias
+			}
+			if err != nil || n.Kind != yaml.SequenceNode || i < 0 || i >= len(n.Content) {
+				return nil
+			}
+			n = n.Content[i]
+			index = s.TrimPrefix(rest, "[")
+		}
+	}
+	return n
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// the path of the first value on a line, for errors that only have a line
+func (config *Config) pathAt(line int) string {
+	var find func(n *yaml.Node, path string) (string, bool)
+	find = func(n *yaml.Node, path string) (string, bool) {
+		switch n.Kind {
+		case yaml.DocumentNode:
+			for _, c := range n.Content {
+				if p, ok := find(c, path); ok {
+					return p, true
+				}
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				p := joinPath(path, n.Content[i].Value)
+				if n.Content[i].Line == line || n.Content[i+1].Line == line && n.Content[i+1].Kind == yaml.ScalarNode {
+					return p, true
+				}
+				if p, ok := find(n.Content[i+1], p); ok {
+					return p, true
+				}
+			}
+		case yaml.SequenceNode:
+			for i, c := range n.Content {
+				p := fmt.Sprintf("%s[%d]", path, i)
+				if c.Line == line && c.Kind == yaml.ScalarNode {
+					return p, true
+				}
+				if p, ok := find(c, p); ok {
+					return p, true
+				}
+			}
+		}
+		return "", false
+	}
+
+	if config.root != nil {
+		if p, ok := find(config.root, ""); ok {
+			return p
+		}
+	}
+	return "(config)"
+}
+
+func joinPath(parts ...string) string {
+	var path []string
+	for _, p := range parts {
+		if len(p) > 0 {
+			path = append(path, p)
+		}
+	}
+	return s.Join(path, ".")
+}
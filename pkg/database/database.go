@@ -0,0 +1,79 @@
+// Package database connects to mapper's database with the driver named by
+// the database section's type. Drivers register themselves here (those built
+// into mapper are in package drivers), each with how to make its data source
+// name from the section's settings and how statements are written for it
+// (see package query).
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	s "strings"
+
+	"github.com/jeff-blank/mapper/pkg/query"
+)
+
+// Driver is a database type that mapper can use.
+type Driver struct {
+	// the database/sql driver name
+	Name string
+	// the data source name for a database section without a dsn
+	DSN func(dbconfig map[string]string) string
+	// how statements are written for the database
+	Style query.Style
+}
+
+var drivers = make(map[string]Driver)
+
+// Register makes a driver available as a database type.
+func Register(dbtype string, driver Driver) {
+	drivers[s.ToLower(dbtype)] = driver
+}
+
+// Lookup finds the driver for a database type.
+func Lookup(dbtype string) (Driver, bool) {
+	driver, ok := drivers[s.ToLower(dbtype)]
+	return driver, ok
+}
+
+// Types lists the database types, sorted.
+func Types() []string {
+	return slices.Sorted(maps.Keys(drivers))
+}
+
+// CheckType checks that a database type has a driver registered.
+func CheckType(dbtype string) error {
+	_, err := lookupType(dbtype)
+	return err
+}
+
+func lookupType(dbtype string) (Driver, error) {
+	driver, ok := Lookup(dbtype)
+	if ok {
+		return driver, nil
+	}
+	if len(drivers) == 0 {
+		return Driver{}, fmt.Errorf("unknown database type '%s' (no database drivers are registered)", dbtype)
+	}
+	return Driver{}, fmt.Errorf("unknown database type '%s' (not one of %s)", dbtype, s.Join(Types(), ", "))
+}
+
+// Open connects to the database in a database section, using its dsn if it
+// has one, returning the connection and how statements are written for it.
+func Open(dbconfig map[string]string) (*sql.DB, query.Style, error) {
+	driver, err := lookupType(dbconfig["type"])
+	if err != nil {
+		return nil, query.Style{}, err
+	}
+	dsn := dbconfig["dsn"]
+	if len(dsn) == 0 {
+		dsn = driver.DSN(dbconfig)
+	}
+	dbh, err := sql.Open(driver.Name, dsn)
+	if err != nil {
+		return nil, query.Style{}, fmt.Errorf("sql.Open(): %v", err)
+	}
+	return dbh, driver.Style, nil
+}
@@ -0,0 +1,6 @@
+// Package drivers builds in the databases mapper can use. Importing it for
+// its side effects registers them with package database: postgres (or
+// postgresql), mysql, and, when built with cgo, sqlite (or sqlite3).
+//
+//	import _ "github.com/jeff-blank/mapper/pkg/database/drivers"
+package drivers
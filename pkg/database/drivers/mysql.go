@@ -0,0 +1,23 @@
+package drivers
+
+import (
+	"github.com/go-sql-driver/mysql"
+	"github.com/jeff-blank/mapper/pkg/database"
+	"github.com/jeff-blank/mapper/pkg/query"
+)
+
+func init() {
+	database.Register("mysql", database.Driver{Name: "mysql", DSN: mysqlDSN, Style: query.MySQL})
+}
+
+// username:password@tcp(host)/name, then connect_opts (e.g.
+// "?parseTime=true")
+func mysqlDSN(dbconfig map[string]string) string {
+	cfg := mysql.NewConfig()
+	cfg.User = dbconfig["username"]
+	cfg.Passwd = dbconfig["password"]
+	cfg.Net = "tcp"
+	cfg.Addr = dbconfig["host"]
+	cfg.DBName = dbconfig["name"]
+	return cfg.FormatDSN() + dbconfig["connect_opts"]
+}
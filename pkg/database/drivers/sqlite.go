@@ -0,0 +1,21 @@
+//go:build cgo
+
+package drivers
+
+import (
+	"github.com/jeff-blank/mapper/pkg/database"
+	"github.com/jeff-blank/mapper/pkg/query"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// the SQLite driver is built with cgo, so without it there's no sqlite type
+func init() {
+	driver := database.Driver{Name: "sqlite3", DSN: sqliteDSN, Style: query.SQLite}
+	database.Register("sqlite", driver)
+	database.Register("sqlite3", driver)
+}
+
+// the database file is the name, then connect_opts (e.g. "?mode=ro")
+func sqliteDSN(dbconfig map[string]string) string {
+	return dbconfig["name"] + dbconfig["connect_opts"]
+}
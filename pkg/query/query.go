@@ -0,0 +1,279 @@
+// Package query builds the SQL that mapper runs against its database. Values
+// are never pasted into the SQL: they're passed as bind parameters, written
+// the way the database expects. Identifiers that don't come straight from the
+// configuration file are checked and quoted, and the pieces of SQL that do
+// (tables, where conditions and the like) are checked for anything that
+// would end the statement or comment out the rest of it.
+//
+// Conditions can have named parameters, written :name, whose values are
+// given separately:
+//
+//	q := query.NewSelect("state", "count(*)").From("events").GroupBy("state")
+//	q.Where(query.Condition{SQL: "state = :state", Params: query.Params{"state": "MN"}})
+//	sql, args, err := q.Build(query.Postgres)
+//	// select state, count(*) from events where (state = $1) group by state
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	s "strings"
+	"unicode"
+)
+
+// Style is how a database writes bind parameters and quotes identifiers.
+type Style struct {
+	// the nth bind parameter, counting from 1
+	Placeholder func(n int) string
+	// an identifier (one part of a dotted name) that's already been checked
+	Quote func(id string) string
+}
+
+// Postgres writes bind parameters as $1, $2, ... and quotes identifiers with
+// double quotes.
+var Postgres = Style{
+	Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	Quote:       func(id string) string { return `"` + id + `"` },
+}
+
+// MySQL writes bind parameters as ? and quotes identifiers with backquotes.
+var MySQL = Style{
+	Placeholder: func(int) string { return "?" },
+	Quote:       func(id string) string { return "`" + id + "`" },
+}
+
+// SQLite writes bind parameters as ? and quotes identifiers with double
+// quotes.
+var SQLite = Style{
+	Placeholder: func(int) string { return "?" },
+	Quote:       func(id string) string { return `"` + id + `"` },
+}
+
+// Params are the values of a condition's named parameters, by name.
+type Params map[string]any
+
+// Condition is a piece of a where clause, with the values of its :name
+// parameters.
+type Condition struct {
+	SQL    string
+	Params Params
+}
+
+var re_ident = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// CheckIdent checks that id is a column or table name, optionally qualified
+// (events.date).
+func CheckIdent(id string) error {
+	for _, part := range s.Split(id, ".") {
+		if !re_ident.MatchString(part) {
+			return fmt.Errorf("'%s' is not a column or table name", id)
+		}
+	}
+	return nil
+}
+
+// Ident checks id with CheckIdent and quotes each part of it.
+func (style Style) Ident(id string) (string, error) {
+	if err := CheckIdent(id); err != nil {
+		return "", err
+	}
+	parts := s.Split(id, ".")
+	for i, part := range parts {
+		parts[i] = style.Quote(part)
+	}
+	return s.Join(parts, "."), nil
+}
+
+// Check looks for anything in a piece of SQL that could change what the
+// statement does, rather than just what it selects: a ';' or a comment
+// outside quotes, or a quote that's never closed.
+func Check(sql string) error {
+	_, err := scan(sql, nil)
+	return err
+}
+
+// Bind replaces the named parameters in a whole statement (a denominator
+// query, say) with bind parameters, returning the statement and the values
+// to go with it.
+func Bind(sql string, params Params, style Style) (string, []any, error) {
+	var args []any
+	out, err := bind(sql, params, style, &args)
+	return out, args, err
+}
+
+// Positional writes the named parameters in a statement that's prepared
+// once and run with different values, returning the statement and the names
+// of its parameters in the order their values go.
+func Positional(sql string, style Style) (string, []string, error) {
+	var names []string
+	out, err := scan(sql, func(name string) (string, error) {
+		names = append(names, name)
+		return style.Placeholder(len(names)), nil
+	})
+	return out, names, err
+}
+
+func bind(sql string, params Params, style Style, args *[]any) (string, error) {
+	return scan(sql, func(name string) (string, error) {
+		value, ok := params[name]
+		if !ok {
+			return "", fmt.Errorf("no value for parameter ':%s'", name)
+		}
+		*args = append(*args, value)
+		return style.Placeholder(len(*args)), nil
+	})
+}
+
+// go through a piece of SQL, skipping over quoted strings and identifiers
+// and rejecting statement separators and comments; each :name parameter is
+// replaced with what param returns for it (if param isn't nil)
+func scan(sql string, param func(name string) (string, error)) (string, error) {
+	var out s.Builder
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for ; end < len(sql); end++ {
+				if sql[end] == c {
+					// a doubled quote is an escaped one
+					if end+1 < len(sql) && sql[end+1] == c {
+						end++
+						continue
+					}
+					break
+				}
+			}
+			if end >= len(sql) {
+				return "", fmt.Errorf("unterminated %c in '%s'", c, sql)
+			}
+			out.WriteString(sql[i : end+1])
+			i = end
+		case c == ';':
+			return "", fmt.Errorf("';' is not allowed in '%s'", sql)
+		case s.HasPrefix(sql[i:], "--") || s.HasPrefix(sql[i:], "/*"):
+			return "", fmt.Errorf("comments are not allowed in '%s'", sql)
+		case c == ':' && i+1 < len(sql) && sql[i+1] == ':':
+			// a Postgres cast, like now()::date
+			out.WriteString("::")
+			i++
+		case c == ':' && i+1 < len(sql) && isNameStart(sql[i+1]):
+			end := i + 1
+			for end < len(sql) && isNameChar(sql[end]) {
+				end++
+			}
+			if param == nil {
+				out.WriteString(sql[i:end])
+			} else {
+				placeholder, err := param(sql[i+1 : end])
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(placeholder)
+			}
+			i = end - 1
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+// Select is a select statement being built. Its columns, tables and group by
+// are SQL from the configuration, checked with Check when it's built; its
+// conditions are joined with 'and'.
+type Select struct {
+	columns []string
+	from    string
+	where   []Condition
+	groupBy string
+}
+
+// NewSelect starts a select of the given columns (or expressions).
+func NewSelect(columns ...string) *Select {
+	return &Select{columns: columns}
+}
+
+// From sets the tables, with any joins.
+func (q *Select) From(tables string) *Select {
+	q.from = tables
+	return q
+}
+
+// Where adds a condition. A leading 'where' is dropped, so the database
+// section's where will do as it is.
+func (q *Select) Where(cond Condition) *Select {
+	cond.SQL = trimKeyword(cond.SQL, "where")
+	if len(cond.SQL) > 0 {
+		q.where = append(q.where, cond)
+	}
+	return q
+}
+
+// GroupBy sets what rows are grouped by; a leading 'group by' is dropped.
+func (q *Select) GroupBy(expr string) *Select {
+	q.groupBy = trimKeyword(expr, "group by")
+	return q
+}
+
+// Build writes the statement for a database, returning it and the values of
+// its bind parameters.
+func (q *Select) Build(style Style) (string, []any, error) {
+	if len(q.columns) == 0 || len(q.from) == 0 {
+		return "", nil, fmt.Errorf("a select needs columns and tables")
+	}
+	for _, sql := range append([]string{q.from, q.groupBy}, q.columns...) {
+		if err := Check(sql); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var args []any
+	sql := "select " + s.Join(q.columns, ", ") + " from " + q.from
+	for i, cond := range q.where {
+		bound, err := bind(cond.SQL, cond.Params, style, &args)
+		if err != nil {
+			return "", nil, err
+		}
+		if i == 0 {
+			sql += " where "
+		} else {
+			sql += " and "
+		}
+		sql += "(" + bound + ")"
+	}
+	if len(q.groupBy) > 0 {
+		sql += " group by " + q.groupBy
+	}
+	return sql, args, nil
+}
+
+// sql without a leading keyword (of one or more words), in any case
+func trimKeyword(sql, keyword string) string {
+	sql = s.TrimSpace(sql)
+	words := s.Fields(sql)
+	kw := s.Fields(keyword)
+	if len(words) < len(kw) {
+		return sql
+	}
+	for i := range kw {
+		if !s.EqualFold(words[i], kw[i]) {
+			return sql
+		}
+	}
+	// skip past the keyword's words, whatever the spacing between them
+	rest := sql
+	for _, word := range kw {
+		rest = s.TrimLeftFunc(rest, unicode.IsSpace)[len(word):]
+	}
+	return s.TrimSpace(rest)
+}
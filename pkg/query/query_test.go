@@ -0,0 +1,81 @@
+package query
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSelectBuild(t *testing.T) {
+	q := NewSelect("s.abbr", "count(*)").
+		From("state s, events e").
+		GroupBy("GROUP  BY s.abbr")
+	q.Where(Condition{SQL: "where e.state_id = s.id or e.state_id is null"})
+	q.Where(Condition{SQL: "s.abbr in (:a, :b) and e.note <> ':a' and e.day::date < :day", Params: Params{"a": "MN", "b": "WI", "day": "2024-01-01"}})
+	q.Where(Condition{SQL: `"e"."date" >= :a`, Params: Params{"a": "2020-01-01"}})
+
+	sql, args, err := q.Build(Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `select s.abbr, count(*) from state s, events e where (e.state_id = s.id or e.state_id is null) and (s.abbr in ($1, $2) and e.note <> ':a' and e.day::date < $3) and ("e"."date" >= $4) group by s.abbr`
+	if sql != want {
+		t.Errorf("got  %s\nwant %s", sql, want)
+	}
+	if !slices.Equal(args, []any{"MN", "WI", "2024-01-01", "2020-01-01"}) {
+		t.Errorf("args %v", args)
+	}
+}
+
+func TestSelectErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		q    *Select
+	}{
+		{"missing param", NewSelect("a").From("t").Where(Condition{SQL: "a = :b"})},
+		{"semicolon", NewSelect("a").From("t; drop table t")},
+		{"comment", NewSelect("a").From("t").Where(Condition{SQL: "a = 1 -- and b = 2"})},
+		{"block comment", NewSelect("a /* x */").From("t")},
+		{"unterminated", NewSelect("a").From("t").Where(Condition{SQL: "a = 'x"})},
+		{"no tables", NewSelect("a")},
+	} {
+		if sql, _, err := tc.q.Build(Postgres); err == nil {
+			t.Errorf("%s: no error for %s", tc.name, sql)
+		}
+	}
+}
+
+func TestIdent(t *testing.T) {
+	for id, want := range map[string]string{
+		"date":           `"date"`,
+		"e.created_at":   `"e"."created_at"`,
+		"MN_glob_id":     `"MN_glob_id"`,
+		"x'; drop t; --": "",
+		"a..b":           "",
+		"1abc":           "",
+		"":               "",
+	} {
+		got, err := Postgres.Ident(id)
+		if len(want) == 0 {
+			if err == nil {
+				t.Errorf("Ident(%q) = %s, want an error", id, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("Ident(%q) = %s, %v; want %s", id, got, err, want)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	sql, args, err := Bind("select id, pop from census where year = :year and 'it''s :not' <> :year", Params{"year": 2020}, Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "select id, pop from census where year = $1 and 'it''s :not' <> $2"; sql != want {
+		t.Errorf("got  %s\nwant %s", sql, want)
+	}
+	if !slices.Equal(args, []any{2020, 2020}) {
+		t.Errorf("args %v", args)
+	}
+}
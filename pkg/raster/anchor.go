@@ -0,0 +1,190 @@
+package raster
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// Anchor is where to label a shape, and how big the shape is
+type Anchor struct {
+	X, Y float64
+	Area float64
+}
+
+// Anchors finds the shapes with the given ids in SVG data. Each is anchored at
+// the centroid of its largest part, or of an element with the id
+// "<id>-label" if the SVG has one; its area is that of all its parts. Without
+// a geometry, positions are in the SVG's user units and areas in square
+// pixels at its own size; with a geometry (see Geometry()), both are in
+// pixels of the image Rasterize() would make.
+func Anchors(svgData []byte, ids []string, geometry string) (map[string]Anchor, error) {
+	root, err := parse(bytes.NewReader(svgData))
+	if err != nil {
+		return nil, err
+	}
+	if root.name != "svg" {
+		return nil, fmt.Errorf("raster: root element is <%s>, not <svg>", root.name)
+	}
+
+	width, height, view := intrinsicSize(root)
+	pixels := view
+	position := identity()
+	if len(geometry) > 0 {
+		if width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("raster: can't determine image size from width/height/viewBox")
+		}
+		outW, outH, err := Geometry(geometry, width, height)
+		if err != nil {
+			return nil, err
+		}
+		pixels = scaleMatrix(float64(outW)/width, float64(outH)/height).mul(view)
+		position = pixels
+	}
+
+	wanted := make(map[string]bool, 2*len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+		wanted[id+"-label"] = true
+	}
+	shapes := make(map[string][][]point)
+	findShapes(root, identity(), wanted, shapes)
+
+	// areas scale with the determinant
+	areaScale := math.Abs(pixels.a*pixels.d - pixels.b*pixels.c)
+	anchors := make(map[string]Anchor)
+	for _, id := range ids {
+		polys, ok := shapes[id]
+		if !ok {
+			continue
+		}
+		area := 0.0
+		for _, poly := range polys {
+			area += math.Abs(polygonArea(poly))
+		}
+
+		if label, ok := shapes[id+"-label"]; ok {
+			polys = label
+		}
+		c, ok := largestCentroid(polys)
+		if !ok {
+			continue
+		}
+		c = position.apply(c)
+		anchors[id] = Anchor{X: c.x, Y: c.y, Area: area * areaScale}
+	}
+	return anchors, nil
+}
+
+// collect the outlines, in the root's user units, of the elements with the
+// wanted ids. Hidden elements count, so anchors can be invisible.
+func findShapes(n *node, ctm matrix, wanted map[string]bool, shapes map[string][][]point) {
+	for _, child := range n.children {
+		if len(child.name) == 0 || skipElements[child.name] {
+			continue
+		}
+		cctm := ctm
+		if t, ok := child.attrs["transform"]; ok {
+			cctm = ctm.mul(parseTransform(t))
+		}
+
+		switch child.name {
+		case "g", "a", "switch":
+			findShapes(child, cctm, wanted, shapes)
+		case "svg":
+			x, _ := length(child.attrs["x"])
+			y, _ := length(child.attrs["y"])
+			_, _, view := intrinsicSize(child)
+			findShapes(child, cctm.mul(translateMatrix(x, y)).mul(view), wanted, shapes)
+		default:
+			id := child.attrs["id"]
+			if !wanted[id] {
+				continue
+			}
+			if _, ok := shapes[id]; ok {
+				continue
+			}
+			if p := shapePath(child); p != nil {
+				shapes[id] = p.transform(cctm).flatten()
+			}
+		}
+	}
+}
+
+// signed area of a polygon (shoelace formula); it needn't be closed
+func polygonArea(poly []point) float64 {
+	a := 0.0
+	for i := range poly {
+		p, q := poly[i], poly[(i+1)%len(poly)]
+		a += p.x*q.y - q.x*p.y
+	}
+	return a / 2
+}
+
+// the centroid of the largest polygon; degenerate ones (lines, points) use
+// the mean of their points
+func largestCentroid(polys [][]point) (point, bool) {
+	var (
+		best     []point
+		bestArea = -1.0
+	)
+	for _, poly := range polys {
+		if a := math.Abs(polygonArea(poly)); len(poly) > 0 && a > bestArea {
+			best, bestArea = poly, a
+		}
+	}
+	if best == nil {
+		return point{}, false
+	}
+
+	a := polygonArea(best)
+	if math.Abs(a) < 1e-9 {
+		var sum point
+		for _, p := range best {
+			sum.x += p.x
+			sum.y += p.y
+		}
+		return point{sum.x / float64(len(best)), sum.y / float64(len(best))}, true
+	}
+
+	var c point
+	for i := range best {
+		p, q := best[i], best[(i+1)%len(best)]
+		cross := p.x*q.y - q.x*p.y
+		c.x += (p.x + q.x) * cross
+		c.y += (p.y + q.y) * cross
+	}
+	return point{c.x / (6 * a), c.y / (6 * a)}, true
+}
+
+// ShapeIds lists the ids of the shapes (paths, polygons and so on) in SVG
+// data, in document order, including hidden ones
+func ShapeIds(svgData []byte) ([]string, error) {
+	root, err := parse(bytes.NewReader(svgData))
+	if err != nil {
+		return nil, err
+	}
+	if root.name != "svg" {
+		return nil, fmt.Errorf("raster: root element is <%s>, not <svg>", root.name)
+	}
+
+	var ids []string
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, child := range n.children {
+			if len(child.name) == 0 || skipElements[child.name] {
+				continue
+			}
+			switch child.name {
+			case "g", "a", "switch", "svg":
+				walk(child)
+			default:
+				if id := child.attrs["id"]; len(id) > 0 && shapePath(child) != nil {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	walk(root)
+	return ids, nil
+}
@@ -0,0 +1,136 @@
+package raster
+
+import (
+	s "strings"
+)
+
+// a rule from a <style> element. Only simple selectors are supported: an
+// element name, .class, #id, or a combination like path.county; rules with
+// combinators, attribute selectors or pseudo-classes are ignored.
+type cssRule struct {
+	element string
+	id      string
+	classes []string
+	decls   string
+}
+
+// collect the rules from every <style> element in the document
+func stylesheet(root *node) []cssRule {
+	var rules []cssRule
+
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, child := range n.children {
+			if child.name == "style" {
+				var css s.Builder
+				for _, text := range child.children {
+					css.WriteString(text.text)
+				}
+				rules = append(rules, parseCss(css.String())...)
+			} else if len(child.name) > 0 {
+				walk(child)
+			}
+		}
+	}
+	walk(root)
+
+	return rules
+}
+
+func parseCss(css string) []cssRule {
+	var rules []cssRule
+
+	// strip comments
+	for {
+		start := s.Index(css, "/*")
+		if start < 0 {
+			break
+		}
+		end := s.Index(css[start+2:], "*/")
+		if end < 0 {
+			css = css[:start]
+			break
+		}
+		css = css[:start] + css[start+2+end+2:]
+	}
+
+	for {
+		open := s.IndexByte(css, '{')
+		if open < 0 {
+			break
+		}
+		close := s.IndexByte(css[open:], '}')
+		if close < 0 {
+			break
+		}
+		selectors, decls := css[:open], css[open+1:open+close]
+		css = css[open+close+1:]
+
+		// skip @media and friends along with their contents
+		if s.HasPrefix(s.TrimSpace(selectors), "@") {
+			continue
+		}
+
+		for _, sel := range s.Split(selectors, ",") {
+			sel = s.TrimSpace(sel)
+			if len(sel) == 0 || s.ContainsAny(sel, " >+~[:*") {
+				continue
+			}
+			rule := cssRule{decls: decls}
+			for len(sel) > 0 {
+				end := s.IndexAny(sel[1:], ".#") + 1
+				if end == 0 {
+					end = len(sel)
+				}
+				part := sel[:end]
+				sel = sel[end:]
+				switch part[0] {
+				case '.':
+					rule.classes = append(rule.classes, part[1:])
+				case '#':
+					rule.id = part[1:]
+				default:
+					rule.element = part
+				}
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+func (rule cssRule) matches(n *node) bool {
+	if len(rule.element) > 0 && rule.element != n.name {
+		return false
+	}
+	if len(rule.id) > 0 && rule.id != n.attrs["id"] {
+		return false
+	}
+	classes := s.Fields(n.attrs["class"])
+	for _, want := range rule.classes {
+		found := false
+		for _, c := range classes {
+			if c == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity, for ordering matching rules: ids, then classes, then elements
+func (rule cssRule) specificity() int {
+	spec := len(rule.classes) * 10
+	if len(rule.id) > 0 {
+		spec += 100
+	}
+	if len(rule.element) > 0 {
+		spec++
+	}
+	return spec
+}
@@ -0,0 +1,569 @@
+package raster
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	s "strings"
+)
+
+type point struct {
+	x, y float64
+}
+
+// affine transform [a c e; b d f] as in SVG's matrix(a b c d e f)
+type matrix struct {
+	a, b, c, d, e, f float64
+}
+
+func identity() matrix {
+	return matrix{1, 0, 0, 1, 0, 0}
+}
+
+func scaleMatrix(sx, sy float64) matrix {
+	return matrix{sx, 0, 0, sy, 0, 0}
+}
+
+func translateMatrix(tx, ty float64) matrix {
+	return matrix{1, 0, 0, 1, tx, ty}
+}
+
+// m.mul(n) applies n first, then m
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		a: m.a*n.a + m.c*n.b,
+		b: m.b*n.a + m.d*n.b,
+		c: m.a*n.c + m.c*n.d,
+		d: m.b*n.c + m.d*n.d,
+		e: m.a*n.e + m.c*n.f + m.e,
+		f: m.b*n.e + m.d*n.f + m.f,
+	}
+}
+
+func (m matrix) apply(p point) point {
+	return point{m.a*p.x + m.c*p.y + m.e, m.b*p.x + m.d*p.y + m.f}
+}
+
+// average linear scale factor, for stroke widths and font sizes
+func (m matrix) scale() float64 {
+	return math.Sqrt(math.Abs(m.a*m.d - m.b*m.c))
+}
+
+// parse an SVG transform attribute
+func parseTransform(str string) matrix {
+	m := identity()
+	for len(s.TrimSpace(str)) > 0 {
+		open := s.IndexByte(str, '(')
+		close := s.IndexByte(str, ')')
+		if open < 0 || close < open {
+			break
+		}
+		name := s.Trim(s.TrimSpace(str[:open]), ",")
+		name = s.TrimSpace(name)
+		args := numbers(str[open+1 : close])
+		str = str[close+1:]
+
+		arg := func(i int, def float64) float64 {
+			if i < len(args) {
+				return args[i]
+			}
+			return def
+		}
+
+		var t matrix
+		switch name {
+		case "matrix":
+			if len(args) != 6 {
+				continue
+			}
+			t = matrix{args[0], args[1], args[2], args[3], args[4], args[5]}
+		case "translate":
+			t = translateMatrix(arg(0, 0), arg(1, 0))
+		case "scale":
+			sx := arg(0, 1)
+			t = scaleMatrix(sx, arg(1, sx))
+		case "rotate":
+			a := arg(0, 0) * math.Pi / 180
+			cx, cy := arg(1, 0), arg(2, 0)
+			t = translateMatrix(cx, cy).
+				mul(matrix{math.Cos(a), math.Sin(a), -math.Sin(a), math.Cos(a), 0, 0}).
+				mul(translateMatrix(-cx, -cy))
+		case "skewX":
+			t = matrix{1, 0, math.Tan(arg(0, 0) * math.Pi / 180), 1, 0, 0}
+		case "skewY":
+			t = matrix{1, math.Tan(arg(0, 0) * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			continue
+		}
+		m = m.mul(t)
+	}
+	return m
+}
+
+// a path is a list of subpaths made of lines and cubic curves
+type segment struct {
+	op  byte // 'M', 'L', 'C' or 'Z'
+	pts []point
+}
+
+type path []segment
+
+func (p path) transform(m matrix) path {
+	out := make(path, len(p))
+	for i, seg := range p {
+		pts := make([]point, len(seg.pts))
+		for j, pt := range seg.pts {
+			pts[j] = m.apply(pt)
+		}
+		out[i] = segment{seg.op, pts}
+	}
+	return out
+}
+
+// convert curves to line segments; closed subpaths end with their first point
+func (p path) flatten() [][]point {
+	var (
+		polys [][]point
+		cur   []point
+	)
+
+	for _, seg := range p {
+		switch seg.op {
+		case 'M':
+			if len(cur) > 0 {
+				polys = append(polys, cur)
+			}
+			cur = []point{seg.pts[0]}
+		case 'L':
+			if len(cur) == 0 {
+				cur = []point{seg.pts[0]}
+			} else {
+				cur = append(cur, seg.pts[0])
+			}
+		case 'C':
+			if len(cur) == 0 {
+				cur = []point{seg.pts[2]}
+				continue
+			}
+			p0 := cur[len(cur)-1]
+			p1, p2, p3 := seg.pts[0], seg.pts[1], seg.pts[2]
+			l := dist(p0, p1) + dist(p1, p2) + dist(p2, p3)
+			n := int(math.Ceil(l / 2))
+			n = max(1, min(n, 64))
+			for i := 1; i <= n; i++ {
+				t := float64(i) / float64(n)
+				mt := 1 - t
+				cur = append(cur, point{
+					mt*mt*mt*p0.x + 3*mt*mt*t*p1.x + 3*mt*t*t*p2.x + t*t*t*p3.x,
+					mt*mt*mt*p0.y + 3*mt*mt*t*p1.y + 3*mt*t*t*p2.y + t*t*t*p3.y,
+				})
+			}
+		case 'Z':
+			if len(cur) > 0 {
+				cur = append(cur, cur[0])
+				polys = append(polys, cur)
+				cur = nil
+			}
+		}
+	}
+	if len(cur) > 0 {
+		polys = append(polys, cur)
+	}
+	return polys
+}
+
+func dist(a, b point) float64 {
+	return math.Hypot(b.x-a.x, b.y-a.y)
+}
+
+// build a path for a basic shape element
+func shapePath(n *node) path {
+	attr := func(name string) float64 {
+		v, _ := length(n.attrs[name])
+		return v
+	}
+
+	switch n.name {
+	case "path":
+		p, err := parsePathData(n.attrs["d"])
+		if err != nil && len(p) == 0 {
+			return nil
+		}
+		// as per the spec, render up to the first error
+		return p
+	case "rect":
+		x, y, w, h := attr("x"), attr("y"), attr("width"), attr("height")
+		if w <= 0 || h <= 0 {
+			return nil
+		}
+		return path{
+			{'M', []point{{x, y}}},
+			{'L', []point{{x + w, y}}},
+			{'L', []point{{x + w, y + h}}},
+			{'L', []point{{x, y + h}}},
+			{'Z', nil},
+		}
+	case "circle":
+		r := attr("r")
+		return ellipsePath(attr("cx"), attr("cy"), r, r)
+	case "ellipse":
+		return ellipsePath(attr("cx"), attr("cy"), attr("rx"), attr("ry"))
+	case "line":
+		return path{
+			{'M', []point{{attr("x1"), attr("y1")}}},
+			{'L', []point{{attr("x2"), attr("y2")}}},
+		}
+	case "polyline", "polygon":
+		nums := numbers(n.attrs["points"])
+		if len(nums) < 4 {
+			return nil
+		}
+		p := path{{'M', []point{{nums[0], nums[1]}}}}
+		for i := 2; i+1 < len(nums); i += 2 {
+			p = append(p, segment{'L', []point{{nums[i], nums[i+1]}}})
+		}
+		if n.name == "polygon" {
+			p = append(p, segment{'Z', nil})
+		}
+		return p
+	}
+	return nil
+}
+
+func ellipsePath(cx, cy, rx, ry float64) path {
+	if rx <= 0 || ry <= 0 {
+		return nil
+	}
+	// four cubic quarter-arcs
+	k := 0.5522847498
+	return path{
+		{'M', []point{{cx + rx, cy}}},
+		{'C', []point{{cx + rx, cy + k*ry}, {cx + k*rx, cy + ry}, {cx, cy + ry}}},
+		{'C', []point{{cx - k*rx, cy + ry}, {cx - rx, cy + k*ry}, {cx - rx, cy}}},
+		{'C', []point{{cx - rx, cy - k*ry}, {cx - k*rx, cy - ry}, {cx, cy - ry}}},
+		{'C', []point{{cx + k*rx, cy - ry}, {cx + rx, cy - k*ry}, {cx + rx, cy}}},
+		{'Z', nil},
+	}
+}
+
+// scanner for path data
+type pathScanner struct {
+	str string
+	pos int
+}
+
+func (ps *pathScanner) skipSeparators() {
+	for ps.pos < len(ps.str) && s.IndexByte(" \t\r\n,", ps.str[ps.pos]) >= 0 {
+		ps.pos++
+	}
+}
+
+func (ps *pathScanner) atNumber() bool {
+	ps.skipSeparators()
+	return ps.pos < len(ps.str) && s.IndexByte("+-.0123456789", ps.str[ps.pos]) >= 0
+}
+
+func (ps *pathScanner) number() (float64, error) {
+	ps.skipSeparators()
+	start := ps.pos
+	i := ps.pos
+	if i < len(ps.str) && (ps.str[i] == '+' || ps.str[i] == '-') {
+		i++
+	}
+	digits := false
+	for i < len(ps.str) && ps.str[i] >= '0' && ps.str[i] <= '9' {
+		i++
+		digits = true
+	}
+	if i < len(ps.str) && ps.str[i] == '.' {
+		i++
+		for i < len(ps.str) && ps.str[i] >= '0' && ps.str[i] <= '9' {
+			i++
+			digits = true
+		}
+	}
+	if digits && i < len(ps.str) && (ps.str[i] == 'e' || ps.str[i] == 'E') {
+		j := i + 1
+		if j < len(ps.str) && (ps.str[j] == '+' || ps.str[j] == '-') {
+			j++
+		}
+		if j < len(ps.str) && ps.str[j] >= '0' && ps.str[j] <= '9' {
+			for j < len(ps.str) && ps.str[j] >= '0' && ps.str[j] <= '9' {
+				j++
+			}
+			i = j
+		}
+	}
+	if !digits {
+		return 0, fmt.Errorf("expected number at offset %d", start)
+	}
+	ps.pos = i
+	return strconv.ParseFloat(ps.str[start:i], 64)
+}
+
+// arc flags may be written without separators ("a1 1 0 01 1 1")
+func (ps *pathScanner) flag() (bool, error) {
+	ps.skipSeparators()
+	if ps.pos < len(ps.str) && (ps.str[ps.pos] == '0' || ps.str[ps.pos] == '1') {
+		ps.pos++
+		return ps.str[ps.pos-1] == '1', nil
+	}
+	return false, fmt.Errorf("expected flag at offset %d", ps.pos)
+}
+
+func (ps *pathScanner) numbers(n int) ([]float64, error) {
+	nums := make([]float64, n)
+	for i := range nums {
+		v, err := ps.number()
+		if err != nil {
+			return nil, err
+		}
+		nums[i] = v
+	}
+	return nums, nil
+}
+
+// parse SVG path data into absolute lines and cubic curves. On error, the
+// path up to the error is returned along with the error.
+func parsePathData(d string) (path, error) {
+	var (
+		p                path
+		cur, start, ctrl point
+		lastCmd          byte
+	)
+
+	ps := &pathScanner{str: d}
+	for {
+		ps.skipSeparators()
+		if ps.pos >= len(ps.str) {
+			break
+		}
+
+		cmd := ps.str[ps.pos]
+		if s.IndexByte("MmLlHhVvCcSsQqTtAaZz", cmd) >= 0 {
+			ps.pos++
+		} else if lastCmd != 0 && ps.atNumber() {
+			// implicit repeat; a moveto repeats as a lineto
+			cmd = lastCmd
+			if cmd == 'M' {
+				cmd = 'L'
+			} else if cmd == 'm' {
+				cmd = 'l'
+			}
+		} else {
+			return p, fmt.Errorf("unexpected '%c' at offset %d", cmd, ps.pos)
+		}
+
+		rel := cmd >= 'a' && cmd <= 'z'
+		abs := func(x, y float64) point {
+			if rel {
+				return point{cur.x + x, cur.y + y}
+			}
+			return point{x, y}
+		}
+
+		upper := cmd &^ 0x20
+		switch upper {
+		case 'Z':
+			p = append(p, segment{'Z', nil})
+			cur = start
+			ctrl = cur
+		case 'M', 'L', 'T':
+			n, err := ps.numbers(2)
+			if err != nil {
+				return p, err
+			}
+			pt := abs(n[0], n[1])
+			switch upper {
+			case 'M':
+				p = append(p, segment{'M', []point{pt}})
+				start = pt
+				ctrl = pt
+			case 'L':
+				p = append(p, segment{'L', []point{pt}})
+				ctrl = pt
+			case 'T':
+				q := cur
+				if s.IndexByte("QqTt", lastCmd) >= 0 {
+					q = point{2*cur.x - ctrl.x, 2*cur.y - ctrl.y}
+				}
+				p = append(p, quadSegment(cur, q, pt))
+				ctrl = q
+			}
+			cur = pt
+		case 'H':
+			n, err := ps.numbers(1)
+			if err != nil {
+				return p, err
+			}
+			if rel {
+				cur = point{cur.x + n[0], cur.y}
+			} else {
+				cur = point{n[0], cur.y}
+			}
+			p = append(p, segment{'L', []point{cur}})
+			ctrl = cur
+		case 'V':
+			n, err := ps.numbers(1)
+			if err != nil {
+				return p, err
+			}
+			if rel {
+				cur = point{cur.x, cur.y + n[0]}
+			} else {
+				cur = point{cur.x, n[0]}
+			}
+			p = append(p, segment{'L', []point{cur}})
+			ctrl = cur
+		case 'C':
+			n, err := ps.numbers(6)
+			if err != nil {
+				return p, err
+			}
+			c1, c2, pt := abs(n[0], n[1]), abs(n[2], n[3]), abs(n[4], n[5])
+			p = append(p, segment{'C', []point{c1, c2, pt}})
+			ctrl = c2
+			cur = pt
+		case 'S':
+			n, err := ps.numbers(4)
+			if err != nil {
+				return p, err
+			}
+			c1 := cur
+			if s.IndexByte("CcSs", lastCmd) >= 0 {
+				c1 = point{2*cur.x - ctrl.x, 2*cur.y - ctrl.y}
+			}
+			c2, pt := abs(n[0], n[1]), abs(n[2], n[3])
+			p = append(p, segment{'C', []point{c1, c2, pt}})
+			ctrl = c2
+			cur = pt
+		case 'Q':
+			n, err := ps.numbers(4)
+			if err != nil {
+				return p, err
+			}
+			q, pt := abs(n[0], n[1]), abs(n[2], n[3])
+			p = append(p, quadSegment(cur, q, pt))
+			ctrl = q
+			cur = pt
+		case 'A':
+			radii, err := ps.numbers(3)
+			if err != nil {
+				return p, err
+			}
+			large, err := ps.flag()
+			if err != nil {
+				return p, err
+			}
+			sweep, err := ps.flag()
+			if err != nil {
+				return p, err
+			}
+			n, err := ps.numbers(2)
+			if err != nil {
+				return p, err
+			}
+			pt := abs(n[0], n[1])
+			p = append(p, arcSegments(cur, radii[0], radii[1], radii[2], large, sweep, pt)...)
+			ctrl = pt
+			cur = pt
+		}
+		lastCmd = cmd
+	}
+
+	return p, nil
+}
+
+// quadratic Bézier as a cubic
+func quadSegment(p0, q, p3 point) segment {
+	c1 := point{p0.x + 2.0/3.0*(q.x-p0.x), p0.y + 2.0/3.0*(q.y-p0.y)}
+	c2 := point{p3.x + 2.0/3.0*(q.x-p3.x), p3.y + 2.0/3.0*(q.y-p3.y)}
+	return segment{'C', []point{c1, c2, p3}}
+}
+
+// elliptical arc as cubics, following the SVG implementation notes
+// (endpoint to center parameterization)
+func arcSegments(p0 point, rx, ry, phiDeg float64, large, sweep bool, p1 point) []segment {
+	if p0 == p1 {
+		return nil
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		return []segment{{'L', []point{p1}}}
+	}
+
+	phi := phiDeg * math.Pi / 180
+	cosPhi, sinPhi := math.Cos(phi), math.Sin(phi)
+
+	dx, dy := (p0.x-p1.x)/2, (p0.y-p1.y)/2
+	x1 := cosPhi*dx + sinPhi*dy
+	y1 := -sinPhi*dx + cosPhi*dy
+
+	// scale up radii that are too small
+	if lambda := x1*x1/(rx*rx) + y1*y1/(ry*ry); lambda > 1 {
+		rx *= math.Sqrt(lambda)
+		ry *= math.Sqrt(lambda)
+	}
+
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := 0.0
+	if den != 0 && num > 0 {
+		coef = math.Sqrt(num / den)
+	}
+	if large == sweep {
+		coef = -coef
+	}
+	cx1 := coef * rx * y1 / ry
+	cy1 := -coef * ry * x1 / rx
+
+	cx := cosPhi*cx1 - sinPhi*cy1 + (p0.x+p1.x)/2
+	cy := sinPhi*cx1 + cosPhi*cy1 + (p0.y+p1.y)/2
+
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	theta1 := angle(1, 0, (x1-cx1)/rx, (y1-cy1)/ry)
+	dTheta := angle((x1-cx1)/rx, (y1-cy1)/ry, (-x1-cx1)/rx, (-y1-cy1)/ry)
+	if !sweep && dTheta > 0 {
+		dTheta -= 2 * math.Pi
+	} else if sweep && dTheta < 0 {
+		dTheta += 2 * math.Pi
+	}
+
+	// at most a quarter turn per cubic
+	n := int(math.Ceil(math.Abs(dTheta) / (math.Pi / 2)))
+	delta := dTheta / float64(n)
+	k := 4.0 / 3.0 * math.Tan(delta/4)
+
+	onEllipse := func(t float64) (point, point) {
+		cosT, sinT := math.Cos(t), math.Sin(t)
+		pt := point{
+			cx + rx*cosT*cosPhi - ry*sinT*sinPhi,
+			cy + rx*cosT*sinPhi + ry*sinT*cosPhi,
+		}
+		deriv := point{
+			-rx*sinT*cosPhi - ry*cosT*sinPhi,
+			-rx*sinT*sinPhi + ry*cosT*cosPhi,
+		}
+		return pt, deriv
+	}
+
+	segs := make([]segment, 0, n)
+	t := theta1
+	from, fromD := onEllipse(t)
+	for i := 0; i < n; i++ {
+		to, toD := onEllipse(t + delta)
+		if i == n-1 {
+			to = p1
+		}
+		segs = append(segs, segment{'C', []point{
+			{from.x + k*fromD.x, from.y + k*fromD.y},
+			{to.x - k*toD.x, to.y - k*toD.y},
+			to,
+		}})
+		t += delta
+		from, fromD = to, toD
+	}
+	return segs
+}
@@ -0,0 +1,110 @@
+package raster
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestParsePathData(t *testing.T) {
+	for _, tc := range []struct {
+		d    string
+		want path
+	}{
+		{"M10 10 h20 v20 H10 z", path{
+			{'M', []point{{10, 10}}},
+			{'L', []point{{30, 10}}},
+			{'L', []point{{30, 30}}},
+			{'L', []point{{10, 30}}},
+			{'Z', nil},
+		}},
+		// an implicit repeat of a moveto is a lineto
+		{"m1,1 2,2 l-1-1", path{
+			{'M', []point{{1, 1}}},
+			{'L', []point{{3, 3}}},
+			{'L', []point{{2, 2}}},
+		}},
+		{"M0 0C1 2 3 4 5 6s1 1 2 2", path{
+			{'M', []point{{0, 0}}},
+			{'C', []point{{1, 2}, {3, 4}, {5, 6}}},
+			{'C', []point{{7, 8}, {6, 7}, {7, 8}}},
+		}},
+		{"M0 0Q3 3 6 0", path{
+			{'M', []point{{0, 0}}},
+			{'C', []point{{2, 2}, {4, 2}, {6, 0}}},
+		}},
+		// a zero radius makes a line
+		{"M0 0A0 5 0 0 1 10 0", path{
+			{'M', []point{{0, 0}}},
+			{'L', []point{{10, 0}}},
+		}},
+	} {
+		got, err := parsePathData(tc.d)
+		if err != nil {
+			t.Errorf("%s: %v", tc.d, err)
+			continue
+		}
+		if !equalPaths(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.d, got, tc.want)
+		}
+	}
+
+	for _, d := range []string{"M10", "M0 0 X 5", "M0 0 A5 5 0 2 1 10 0"} {
+		if _, err := parsePathData(d); err == nil {
+			t.Errorf("%s: no error", d)
+		}
+	}
+}
+
+func TestArcs(t *testing.T) {
+	for _, tc := range []struct {
+		d string
+		// the circle the arc is on, and a point it passes through
+		centre  point
+		radius  float64
+		through point
+	}{
+		// half circles around (10, 0), above and below
+		{"M0 0 A10 10 0 0 1 20 0", point{10, 0}, 10, point{10, -10}},
+		{"M0 0 A10 10 0 0 0 20 0", point{10, 0}, 10, point{10, 10}},
+		// radii too small to reach are scaled up to fit
+		{"M0 0 A1 1 0 0 1 20 0", point{10, 0}, 10, point{10, -10}},
+		// three quarters of a circle around (0, 0), the long way round
+		{"M10 0 A10 10 0 1 1 0 -10", point{0, 0}, 10, point{-10, 0}},
+		// and the short way
+		{"M10 0 A10 10 0 0 0 0 -10", point{0, 0}, 10, point{10 / math.Sqrt2, -10 / math.Sqrt2}},
+	} {
+		p, err := parsePathData(tc.d)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.d, err)
+		}
+		polys := p.flatten()
+		if len(polys) != 1 {
+			t.Fatalf("%s: %d subpaths", tc.d, len(polys))
+		}
+		poly := polys[0]
+		if end, want := poly[len(poly)-1], p[len(p)-1].pts[2]; dist(end, want) > 1e-9 {
+			t.Errorf("%s: ends at %v, want %v", tc.d, end, want)
+		}
+		nearest := math.Inf(1)
+		for _, pt := range poly {
+			if r := dist(pt, tc.centre); math.Abs(r-tc.radius) > 0.05 {
+				t.Errorf("%s: %v is %.2f from %v, not %v", tc.d, pt, r, tc.centre, tc.radius)
+				break
+			}
+			nearest = min(nearest, dist(pt, tc.through))
+		}
+		// the points are a couple of pixels apart
+		if nearest > 1.5 {
+			t.Errorf("%s: doesn't pass through %v", tc.d, tc.through)
+		}
+	}
+}
+
+func equalPaths(a, b path) bool {
+	return slices.EqualFunc(a, b, func(x, y segment) bool {
+		return x.op == y.op && slices.EqualFunc(x.pts, y.pts, func(p, q point) bool {
+			return dist(p, q) < 1e-9
+		})
+	})
+}
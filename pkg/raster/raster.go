@@ -0,0 +1,436 @@
+// Package raster renders the subset of SVG used by mapper's input files
+// (paths and basic shapes with fill/stroke styles, groups with transforms,
+// rects and text) into an *image.RGBA without calling out to ImageMagick.
+package raster
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"strconv"
+	s "strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/vector"
+)
+
+// a parsed SVG element; text nodes have an empty name
+type node struct {
+	name     string
+	attrs    map[string]string
+	children []*node
+	text     string
+}
+
+// elements that are never drawn, along with everything inside them
+var skipElements = map[string]bool{
+	"defs":           true,
+	"title":          true,
+	"desc":           true,
+	"metadata":       true,
+	"clipPath":       true,
+	"mask":           true,
+	"marker":         true,
+	"pattern":        true,
+	"symbol":         true,
+	"style":          true,
+	"script":         true,
+	"namedview":      true,
+	"linearGradient": true,
+	"radialGradient": true,
+}
+
+// MaxSide is the largest width or height Geometry gives, in pixels.
+const MaxSide = 16384
+
+// Rasterize renders SVG data at the size given by an ImageMagick-style
+// geometry string (see Geometry()) onto a white background.
+func Rasterize(svgData []byte, geometry string) (*image.RGBA, error) {
+	root, err := svgRoot(svgData)
+	if err != nil {
+		return nil, err
+	}
+	width, height, view := intrinsicSize(root)
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("raster: can't determine image size from width/height/viewBox")
+	}
+
+	outW, outH, err := Geometry(geometry, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, outW, outH))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	ctm := scaleMatrix(float64(outW)/width, float64(outH)/height).mul(view)
+	r := &renderer{img: img, css: stylesheet(root), fonts: make(map[fontKey]font.Face)}
+	r.group(root, ctm, defaultStyle())
+
+	return img, nil
+}
+
+// Size gives the size in pixels of the image Rasterize would make of SVG
+// data at a geometry, without drawing it.
+func Size(svgData []byte, geometry string) (int, int, error) {
+	width, height, err := ImageSize(svgData)
+	if err != nil {
+		return 0, 0, err
+	}
+	return Geometry(geometry, width, height)
+}
+
+// ImageSize gives the SVG's own size, from its width and height or viewBox.
+func ImageSize(svgData []byte) (float64, float64, error) {
+	root, err := svgRoot(svgData)
+	if err != nil {
+		return 0, 0, err
+	}
+	width, height, _ := intrinsicSize(root)
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("raster: can't determine image size from width/height/viewBox")
+	}
+	return width, height, nil
+}
+
+func svgRoot(svgData []byte) (*node, error) {
+	root, err := parse(bytes.NewReader(svgData))
+	if err != nil {
+		return nil, err
+	}
+	if root.name != "svg" {
+		return nil, fmt.Errorf("raster: root element is <%s>, not <svg>", root.name)
+	}
+	return root, nil
+}
+
+func parse(rd io.Reader) (*node, error) {
+	var (
+		root  *node
+		stack []*node
+	)
+
+	dec := xml.NewDecoder(rd)
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("raster: parse SVG: %v", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name.Local, attrs: make(map[string]string, len(t.Attr))}
+			for _, a := range t.Attr {
+				// xlink:href etc. are not used; keep the local name only
+				// when there's no clash with an unprefixed attribute
+				if _, ok := n.attrs[a.Name.Local]; !ok || a.Name.Space == "" {
+					n.attrs[a.Name.Local] = a.Value
+				}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, &node{text: string(t)})
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("raster: no elements in SVG")
+	}
+	return root, nil
+}
+
+// size of the root element in pixels, and the transform from its viewBox
+// (if any) to that size
+func intrinsicSize(root *node) (float64, float64, matrix) {
+	width, wOk := length(root.attrs["width"])
+	height, hOk := length(root.attrs["height"])
+
+	vb := numbers(root.attrs["viewBox"])
+	if len(vb) != 4 || vb[2] <= 0 || vb[3] <= 0 {
+		return width, height, identity()
+	}
+
+	if !wOk && !hOk {
+		width, height = vb[2], vb[3]
+	} else if !wOk {
+		width = height * vb[2] / vb[3]
+	} else if !hOk {
+		height = width * vb[3] / vb[2]
+	}
+
+	// preserveAspectRatio="xMidYMid meet", the default and the only one
+	// supported
+	scale := math.Min(width/vb[2], height/vb[3])
+	tx := (width-vb[2]*scale)/2 - vb[0]*scale
+	ty := (height-vb[3]*scale)/2 - vb[1]*scale
+	return width, height, matrix{scale, 0, 0, scale, tx, ty}
+}
+
+// Geometry computes the output size for an ImageMagick-style geometry string
+// applied to an image of the given size. Supported forms are "WxH" (fit
+// within, preserving aspect ratio), "W" or "Wx" (width), "xH" (height),
+// "WxH!" (exact size), "N%" or "N%xM%" (scale), optionally followed by '>'
+// (only shrink) or '<' (only enlarge). An empty geometry keeps the size.
+// Sizes of more than MaxSide pixels a side are an error.
+func Geometry(geometry string, width, height float64) (int, int, error) {
+	g := s.TrimSpace(geometry)
+	if len(g) == 0 {
+		return int(math.Round(width)), int(math.Round(height)), nil
+	}
+
+	var exact, shrinkOnly, enlargeOnly bool
+	for len(g) > 0 {
+		switch g[len(g)-1] {
+		case '!':
+			exact = true
+		case '>':
+			shrinkOnly = true
+		case '<':
+			enlargeOnly = true
+		default:
+			goto flagsDone
+		}
+		g = g[:len(g)-1]
+	}
+flagsDone:
+
+	wStr, hStr, _ := s.Cut(s.ToLower(g), "x")
+	percent := s.HasSuffix(wStr, "%") || s.HasSuffix(hStr, "%")
+	wStr = s.TrimSuffix(wStr, "%")
+	hStr = s.TrimSuffix(hStr, "%")
+
+	var w, h float64
+	var err error
+	if len(wStr) > 0 {
+		if w, err = strconv.ParseFloat(wStr, 64); err != nil || w <= 0 {
+			return 0, 0, fmt.Errorf("raster: invalid geometry '%s'", geometry)
+		}
+	}
+	if len(hStr) > 0 {
+		if h, err = strconv.ParseFloat(hStr, 64); err != nil || h <= 0 {
+			return 0, 0, fmt.Errorf("raster: invalid geometry '%s'", geometry)
+		}
+	}
+	if w == 0 && h == 0 {
+		return 0, 0, fmt.Errorf("raster: invalid geometry '%s'", geometry)
+	}
+
+	var outW, outH float64
+	switch {
+	case percent:
+		if h == 0 {
+			h = w
+		} else if w == 0 {
+			w = h
+		}
+		outW, outH = width*w/100, height*h/100
+	case exact && w > 0 && h > 0:
+		outW, outH = w, h
+	case h == 0:
+		outW, outH = w, height*w/width
+	case w == 0:
+		outW, outH = width*h/height, h
+	default:
+		scale := math.Min(w/width, h/height)
+		outW, outH = width*scale, height*scale
+	}
+
+	if (shrinkOnly && outW*outH > width*height) || (enlargeOnly && outW*outH < width*height) {
+		outW, outH = width, height
+	}
+	if outW > MaxSide || outH > MaxSide {
+		return 0, 0, fmt.Errorf("raster: geometry '%s' is %.0fx%.0f, more than %d pixels a side", geometry, outW, outH, MaxSide)
+	}
+
+	return max(1, int(math.Round(outW))), max(1, int(math.Round(outH))), nil
+}
+
+type renderer struct {
+	img   *image.RGBA
+	css   []cssRule
+	fonts map[fontKey]font.Face
+	z     *vector.Rasterizer
+	box   image.Rectangle
+}
+
+// draw a container element's children
+func (r *renderer) group(n *node, ctm matrix, st style) {
+	for _, child := range n.children {
+		if len(child.name) == 0 || skipElements[child.name] {
+			continue
+		}
+
+		cst := st.inherit(child, r.css)
+		if !cst.display {
+			continue
+		}
+		cctm := ctm
+		if t, ok := child.attrs["transform"]; ok {
+			cctm = ctm.mul(parseTransform(t))
+		}
+
+		switch child.name {
+		case "g", "a", "switch":
+			r.group(child, cctm, cst)
+		case "svg":
+			// nested viewport: position and viewBox, no clipping
+			x, _ := length(child.attrs["x"])
+			y, _ := length(child.attrs["y"])
+			_, _, view := intrinsicSize(child)
+			r.group(child, cctm.mul(translateMatrix(x, y)).mul(view), cst)
+		case "text":
+			r.text(child, cctm, cst)
+		default:
+			if p := shapePath(child); p != nil {
+				r.shape(p, cctm, cst)
+			}
+		}
+	}
+}
+
+// fill, then stroke, a path. Each is rasterized only over its bounding box,
+// since maps have thousands of small paths.
+func (r *renderer) shape(p path, ctm matrix, st style) {
+	polys := p.transform(ctm).flatten()
+	if len(polys) == 0 {
+		return
+	}
+
+	if !st.fill.none {
+		if z, box := r.rasterizer(polys, 0); z != nil {
+			for _, poly := range polys {
+				if len(poly) < 3 {
+					continue
+				}
+				z.MoveTo(float32(poly[0].x-box.x), float32(poly[0].y-box.y))
+				for _, pt := range poly[1:] {
+					z.LineTo(float32(pt.x-box.x), float32(pt.y-box.y))
+				}
+				z.ClosePath()
+			}
+			r.paint(z, st.fill.colour, st.opacity*st.fillOpacity)
+		}
+	}
+
+	if !st.stroke.none && st.strokeWidth > 0 {
+		hw := st.strokeWidth * ctm.scale() / 2
+		if z, box := r.rasterizer(polys, hw); z != nil {
+			for _, poly := range polys {
+				local := make([]point, len(poly))
+				for i, pt := range poly {
+					local[i] = point{pt.x - box.x, pt.y - box.y}
+				}
+				strokePolyline(z, local, hw)
+			}
+			r.paint(z, st.stroke.colour, st.opacity*st.strokeOpacity)
+		}
+	}
+}
+
+// reset the rasterizer to cover the polygons' bounding box (grown by pad and
+// clipped to the image); returns nil if nothing would be visible
+func (r *renderer) rasterizer(polys [][]point, pad float64) (*vector.Rasterizer, point) {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, poly := range polys {
+		for _, pt := range poly {
+			minX, maxX = math.Min(minX, pt.x), math.Max(maxX, pt.x)
+			minY, maxY = math.Min(minY, pt.y), math.Max(maxY, pt.y)
+		}
+	}
+	pad = math.Max(pad, 0.25) + 1
+	box := image.Rect(
+		int(math.Floor(minX-pad)), int(math.Floor(minY-pad)),
+		int(math.Ceil(maxX+pad)), int(math.Ceil(maxY+pad)),
+	).Intersect(r.img.Bounds())
+	if box.Empty() {
+		return nil, point{}
+	}
+
+	if r.z == nil {
+		r.z = &vector.Rasterizer{}
+	}
+	r.z.Reset(box.Dx(), box.Dy())
+	r.box = box
+	return r.z, point{float64(box.Min.X), float64(box.Min.Y)}
+}
+
+func (r *renderer) paint(z *vector.Rasterizer, c color.RGBA, opacity float64) {
+	alpha := float64(c.A) / 255 * math.Max(0, math.Min(1, opacity))
+	if alpha <= 0 {
+		return
+	}
+	src := color.NRGBA{c.R, c.G, c.B, uint8(math.Round(alpha * 255))}
+	z.DrawOp = draw.Over
+	z.Draw(r.img, r.box, image.NewUniform(src), image.Point{})
+}
+
+// outline each segment of a polyline with a quad of the given half-width and
+// round off the joins; all pieces wind the same way so that overlaps don't
+// cancel out
+func strokePolyline(z *vector.Rasterizer, poly []point, hw float64) {
+	if len(poly) < 2 {
+		return
+	}
+	if hw < 0.25 {
+		// hairlines: keep a minimum width so they stay visible
+		hw = 0.25
+	}
+
+	steps := 8
+	if hw > 2 {
+		steps = 16
+	}
+
+	join := func(c point) {
+		z.MoveTo(float32(c.x+hw), float32(c.y))
+		for i := 1; i < steps; i++ {
+			a := 2 * math.Pi * float64(i) / float64(steps)
+			z.LineTo(float32(c.x+hw*math.Cos(a)), float32(c.y+hw*math.Sin(a)))
+		}
+		z.ClosePath()
+	}
+
+	for i := 1; i < len(poly); i++ {
+		a, b := poly[i-1], poly[i]
+		dx, dy := b.x-a.x, b.y-a.y
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			continue
+		}
+		nx, ny := -dy/l*hw, dx/l*hw
+		// the quad must wind the same way as the join circles
+		z.MoveTo(float32(a.x-nx), float32(a.y-ny))
+		z.LineTo(float32(b.x-nx), float32(b.y-ny))
+		z.LineTo(float32(b.x+nx), float32(b.y+ny))
+		z.LineTo(float32(a.x+nx), float32(a.y+ny))
+		z.ClosePath()
+		if hw >= 0.75 {
+			join(b)
+		}
+	}
+	if hw >= 0.75 {
+		join(poly[0])
+	}
+}
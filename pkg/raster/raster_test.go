@@ -0,0 +1,79 @@
+package raster
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestGeometry(t *testing.T) {
+	for _, tc := range []struct {
+		geometry string
+		w, h     int
+	}{
+		{"", 300, 200},
+		{"600x600", 600, 400},
+		{"600x600!", 600, 600},
+		{"150", 150, 100},
+		{"150x", 150, 100},
+		{"x100", 150, 100},
+		{"50%", 150, 100},
+		{"50%x25%", 150, 50},
+		{"600x600>", 300, 200},
+		{"150x150>", 150, 100},
+		{"150x150<", 300, 200},
+		{"600x600<", 600, 400},
+		{"16384x", 16384, 10923},
+		{"nonsense", 0, 0},
+		{"0x0", 0, 0},
+		{"-5x", 0, 0},
+		{"x", 0, 0},
+		{"16385x", 0, 0},
+		{"1e9x", 0, 0},
+		{"100000000000%", 0, 0},
+	} {
+		w, h, err := Geometry(tc.geometry, 300, 200)
+		if tc.w == 0 {
+			if err == nil {
+				t.Errorf("Geometry(%q) = %dx%d, want an error", tc.geometry, w, h)
+			}
+			continue
+		}
+		if err != nil || w != tc.w || h != tc.h {
+			t.Errorf("Geometry(%q) = %dx%d, %v; want %dx%d", tc.geometry, w, h, err, tc.w, tc.h)
+		}
+	}
+}
+
+func TestRasterize(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="20" height="10">
+  <style>.water { fill: #0000ff }</style>
+  <rect x="0" y="0" width="10" height="10" fill="red"/>
+  <g transform="translate(10,0)">
+    <path class="water" d="M0 0 h10 v5 h-10 z"/>
+  </g>
+</svg>`)
+	img, err := Rasterize(svg, "40x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 20 {
+		t.Fatalf("image is %dx%d, want 40x20", b.Dx(), b.Dy())
+	}
+	for _, tc := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{5, 5, color.RGBA{255, 0, 0, 255}},
+		{15, 15, color.RGBA{255, 0, 0, 255}},
+		{30, 5, color.RGBA{0, 0, 255, 255}},
+		{30, 15, color.RGBA{255, 255, 255, 255}},
+	} {
+		if got := img.RGBAAt(tc.x, tc.y); got != tc.want {
+			t.Errorf("pixel %d,%d is %v, want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+
+	if _, err := Rasterize([]byte(`<html/>`), ""); err == nil {
+		t.Error("no error for a document that isn't SVG")
+	}
+}
@@ -0,0 +1,256 @@
+package raster
+
+import (
+	"image/color"
+	"math"
+	"slices"
+	"strconv"
+	s "strings"
+
+	"golang.org/x/image/colornames"
+)
+
+type paint struct {
+	none   bool
+	colour color.RGBA
+}
+
+// the inherited presentation properties the renderer understands
+type style struct {
+	fill          paint
+	stroke        paint
+	strokeWidth   float64
+	opacity       float64
+	fillOpacity   float64
+	strokeOpacity float64
+	display       bool
+	fontSize      float64
+	fontWeight    string
+	fontStyle     string
+	textAnchor    string
+}
+
+func defaultStyle() style {
+	return style{
+		fill:          paint{colour: color.RGBA{0, 0, 0, 255}},
+		stroke:        paint{none: true},
+		strokeWidth:   1,
+		opacity:       1,
+		fillOpacity:   1,
+		strokeOpacity: 1,
+		display:       true,
+		fontSize:      16,
+		textAnchor:    "start",
+	}
+}
+
+// compute an element's style from its parent's, its presentation attributes,
+// matching stylesheet rules and its style attribute, in increasing order of
+// precedence
+func (st style) inherit(n *node, rules []cssRule) style {
+	props := make(map[string]string)
+	for _, name := range []string{
+		"fill", "stroke", "stroke-width", "opacity", "fill-opacity",
+		"stroke-opacity", "display", "visibility", "font-size",
+		"font-weight", "font-style", "text-anchor",
+	} {
+		if v, ok := n.attrs[name]; ok {
+			props[name] = v
+		}
+	}
+
+	var matched []cssRule
+	for _, rule := range rules {
+		if rule.matches(n) {
+			matched = append(matched, rule)
+		}
+	}
+	slices.SortStableFunc(matched, func(a, b cssRule) int {
+		return a.specificity() - b.specificity()
+	})
+	for _, rule := range matched {
+		declarations(rule.decls, props)
+	}
+
+	declarations(n.attrs["style"], props)
+
+	for name, value := range props {
+		value = s.TrimSpace(value)
+		if value == "inherit" {
+			continue
+		}
+		switch name {
+		case "fill":
+			if p, ok := parsePaint(value); ok {
+				st.fill = p
+			}
+		case "stroke":
+			if p, ok := parsePaint(value); ok {
+				st.stroke = p
+			}
+		case "stroke-width":
+			if v, ok := length(value); ok {
+				st.strokeWidth = v
+			}
+		case "opacity":
+			// applies to the element as a whole, so it accumulates
+			if v, ok := opacity(value); ok {
+				st.opacity *= v
+			}
+		case "fill-opacity":
+			if v, ok := opacity(value); ok {
+				st.fillOpacity = v
+			}
+		case "stroke-opacity":
+			if v, ok := opacity(value); ok {
+				st.strokeOpacity = v
+			}
+		case "display":
+			if value == "none" {
+				st.display = false
+			}
+		case "visibility":
+			if value == "hidden" || value == "collapse" {
+				st.display = false
+			}
+		case "font-size":
+			if v, ok := length(value); ok && v > 0 {
+				st.fontSize = v
+			}
+		case "font-weight":
+			st.fontWeight = value
+		case "font-style":
+			st.fontStyle = value
+		case "text-anchor":
+			st.textAnchor = value
+		}
+	}
+	return st
+}
+
+// add CSS declarations ("name: value; ...") to props
+func declarations(decls string, props map[string]string) {
+	for _, decl := range s.Split(decls, ";") {
+		name, value, ok := s.Cut(decl, ":")
+		if !ok {
+			continue
+		}
+		props[s.TrimSpace(name)] = s.TrimSpace(s.TrimSuffix(s.TrimSpace(value), "!important"))
+	}
+}
+
+func opacity(str string) (float64, bool) {
+	percent := s.HasSuffix(str, "%")
+	v, err := strconv.ParseFloat(s.TrimSuffix(str, "%"), 64)
+	if err != nil {
+		return 0, false
+	}
+	if percent {
+		v /= 100
+	}
+	return math.Max(0, math.Min(1, v)), true
+}
+
+// parse a fill/stroke value; ok is false for anything not understood (URL
+// references to gradients and the like), which leaves the inherited paint
+func parsePaint(str string) (paint, bool) {
+	str = s.ToLower(s.TrimSpace(str))
+	switch str {
+	case "none", "transparent":
+		return paint{none: true}, true
+	case "currentcolor":
+		return paint{colour: color.RGBA{0, 0, 0, 255}}, true
+	}
+	if c, ok := parseColour(str); ok {
+		return paint{colour: c}, true
+	}
+	return paint{}, false
+}
+
+// parse #rgb, #rrggbb, rgb(...) and named colours
+func parseColour(str string) (color.RGBA, bool) {
+	if s.HasPrefix(str, "#") {
+		hex := str[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 {
+			return color.RGBA{}, false
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return color.RGBA{}, false
+		}
+		return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, true
+	}
+
+	if s.HasPrefix(str, "rgb(") && s.HasSuffix(str, ")") {
+		parts := s.Split(str[4:len(str)-1], ",")
+		if len(parts) != 3 {
+			return color.RGBA{}, false
+		}
+		var rgb [3]uint8
+		for i, part := range parts {
+			part = s.TrimSpace(part)
+			percent := s.HasSuffix(part, "%")
+			v, err := strconv.ParseFloat(s.TrimSuffix(part, "%"), 64)
+			if err != nil {
+				return color.RGBA{}, false
+			}
+			if percent {
+				v = v * 255 / 100
+			}
+			rgb[i] = uint8(math.Round(math.Max(0, math.Min(255, v))))
+		}
+		return color.RGBA{rgb[0], rgb[1], rgb[2], 255}, true
+	}
+
+	if c, ok := colornames.Map[str]; ok {
+		return c, true
+	}
+	return color.RGBA{}, false
+}
+
+// parse a length in user units (pixels); percentages are not supported
+func length(str string) (float64, bool) {
+	str = s.TrimSpace(str)
+	if len(str) == 0 || s.HasSuffix(str, "%") {
+		return 0, false
+	}
+
+	units := map[string]float64{
+		"px": 1,
+		"pt": 96.0 / 72.0,
+		"pc": 16,
+		"mm": 96.0 / 25.4,
+		"cm": 96.0 / 2.54,
+		"in": 96,
+	}
+	scale := 1.0
+	if len(str) > 2 {
+		if u, ok := units[str[len(str)-2:]]; ok {
+			scale = u
+			str = str[:len(str)-2]
+		}
+	}
+	v, err := strconv.ParseFloat(s.TrimSpace(str), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v * scale, true
+}
+
+// parse a list of numbers separated by whitespace and/or commas
+func numbers(str string) []float64 {
+	var nums []float64
+	for _, f := range s.FieldsFunc(str, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			break
+		}
+		nums = append(nums, v)
+	}
+	return nums
+}
@@ -0,0 +1,153 @@
+package raster
+
+import (
+	"image"
+	"math"
+	s "strings"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// SVG text is drawn with the Go fonts; font-family is ignored
+type fontKey struct {
+	bold   bool
+	italic bool
+	size   float64
+}
+
+func (r *renderer) face(st style, size float64) font.Face {
+	key := fontKey{
+		bold:   s.Contains(" bold bolder 600 700 800 900 ", " "+st.fontWeight+" "),
+		italic: st.fontStyle == "italic" || st.fontStyle == "oblique",
+		size:   math.Round(size*4) / 4,
+	}
+	if face, ok := r.fonts[key]; ok {
+		return face
+	}
+
+	ttf := goregular.TTF
+	switch {
+	case key.bold && key.italic:
+		ttf = gobolditalic.TTF
+	case key.bold:
+		ttf = gobold.TTF
+	case key.italic:
+		ttf = goitalic.TTF
+	}
+
+	var face font.Face
+	if f, err := opentype.Parse(ttf); err == nil {
+		face, _ = opentype.NewFace(f, &opentype.FaceOptions{
+			Size:    key.size,
+			DPI:     72,
+			Hinting: font.HintingNone,
+		})
+	}
+	r.fonts[key] = face
+	return face
+}
+
+// draw a <text> element: its own character data and that of any <tspan>s,
+// each of which may set a new position
+func (r *renderer) text(n *node, ctm matrix, st style) {
+	x, y := firstLength(n.attrs["x"]), firstLength(n.attrs["y"])
+	pen := point{x, y}
+	started := false
+	r.textRun(n, ctm, st, &pen, &started)
+}
+
+func (r *renderer) textRun(n *node, ctm matrix, st style, pen *point, started *bool) {
+	for _, child := range n.children {
+		if len(child.name) == 0 {
+			// collapse whitespace, dropping it before the first word
+			str := s.Join(s.Fields(child.text), " ")
+			if len(str) > 0 && unicode.IsSpace(rune(child.text[0])) && *started {
+				str = " " + str
+			}
+			if len(str) > 0 && unicode.IsSpace(rune(child.text[len(child.text)-1])) {
+				str += " "
+			}
+			if len(s.TrimSpace(str)) == 0 {
+				continue
+			}
+			*started = true
+			pen.x += r.drawString(str, ctm, st, *pen)
+			continue
+		}
+		if child.name != "tspan" {
+			continue
+		}
+
+		cst := st.inherit(child, r.css)
+		if !cst.display {
+			continue
+		}
+		if v, ok := child.attrs["x"]; ok {
+			pen.x = firstLength(v)
+		}
+		if v, ok := child.attrs["y"]; ok {
+			pen.y = firstLength(v)
+		}
+		pen.x += firstLength(child.attrs["dx"])
+		pen.y += firstLength(child.attrs["dy"])
+		r.textRun(child, ctm, cst, pen, started)
+	}
+}
+
+// draw a string with its baseline at pt (in user space), returning its
+// advance in user space
+func (r *renderer) drawString(str string, ctm matrix, st style, pt point) float64 {
+	scale := ctm.scale()
+	if scale == 0 || st.fill.none {
+		return 0
+	}
+	face := r.face(st, st.fontSize*scale)
+	if face == nil {
+		return 0
+	}
+
+	advance := float64(font.MeasureString(face, str)) / 64
+	switch st.textAnchor {
+	case "middle":
+		pt.x -= advance / scale / 2
+	case "end":
+		pt.x -= advance / scale
+	}
+
+	alpha := float64(st.fill.colour.A) / 255 * st.opacity * st.fillOpacity
+	src := st.fill.colour
+	src.R = uint8(float64(src.R) * alpha)
+	src.G = uint8(float64(src.G) * alpha)
+	src.B = uint8(float64(src.B) * alpha)
+	src.A = uint8(255 * alpha)
+
+	dev := ctm.apply(pt)
+	d := &font.Drawer{
+		Dst:  r.img,
+		Src:  image.NewUniform(src),
+		Face: face,
+		Dot:  fixed.Point26_6{X: fixed.Int26_6(dev.x * 64), Y: fixed.Int26_6(dev.y * 64)},
+	}
+	d.DrawString(str)
+
+	return advance / scale
+}
+
+// x/y on text may be lists; only the first value is used
+func firstLength(str string) float64 {
+	fields := s.FieldsFunc(str, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	})
+	if len(fields) == 0 {
+		return 0
+	}
+	v, _ := length(fields[0])
+	return v
+}
@@ -0,0 +1,208 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	s "strings"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+)
+
+// ClassifyColours builds the colours section for a map from its values: the
+// class breaks computed by the configured method become the minimums, paired
+// with the palette's colours in order.
+func ClassifyColours(data map[string]float64, params config.Classification) (map[string]string, error) {
+	if len(params.Palette) == 0 {
+		return nil, fmt.Errorf("classification: empty palette")
+	}
+	classes := params.Classes
+	if classes == 0 {
+		classes = len(params.Palette)
+	}
+	if classes < 1 || classes > len(params.Palette) {
+		return nil, fmt.Errorf("classification: %d classes but %d palette colours", classes, len(params.Palette))
+	}
+	palette := spreadPalette(params.Palette, classes)
+
+	// zero means "no data" and is never coloured
+	values := make([]float64, 0, len(data))
+	for _, v := range data {
+		if v > 0 {
+			values = append(values, v)
+		}
+	}
+	slices.Sort(values)
+
+	breaks, err := classBreaks(values, classes, params.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	colours := make(map[string]string)
+	for i, b := range breaks {
+		// classes that collapsed into their neighbour (e.g. quantiles of
+		// repetitive data) keep the colour of the lowest one
+		if _, ok := colours[formatValue(b)]; !ok {
+			colours[formatValue(b)] = palette[i]
+		}
+	}
+	// a scale of one colour says nothing (and can't be a gradient)
+	if classes > 1 && len(values) > 1 && len(colours) < 2 {
+		return nil, fmt.Errorf("classification: %s breaks of the values all come to %s, leaving one class", s.ToLower(params.Method), formatValue(breaks[0]))
+	}
+	return colours, nil
+}
+
+// the lower bound of each class, ascending; empty if there are no values.
+// Breaks between whole numbers are rounded up to whole numbers; others are
+// rounded down to three significant figures.
+func classBreaks(values []float64, classes int, method string) ([]float64, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if classes > len(values) {
+		classes = len(values)
+	}
+
+	whole := true
+	for _, v := range values {
+		if v != math.Trunc(v) {
+			whole = false
+			break
+		}
+	}
+	round := func(b float64) float64 {
+		if whole {
+			return math.Ceil(b)
+		}
+		return b
+	}
+
+	min := values[0]
+	max := values[len(values)-1]
+	breaks := make([]float64, classes)
+	breaks[0] = min
+
+	switch s.ToLower(method) {
+	case "quantile":
+		for i := 1; i < classes; i++ {
+			breaks[i] = values[i*len(values)/classes]
+		}
+	case "equal", "equal_interval":
+		width := (max - min) / float64(classes)
+		for i := 1; i < classes; i++ {
+			breaks[i] = round(min + float64(i)*width)
+		}
+	case "geometric", "log":
+		if min <= 0 {
+			return nil, fmt.Errorf("classification: geometric breaks need values above zero, not %s", formatValue(min))
+		}
+		ratio := math.Pow(max/min, 1/float64(classes))
+		for i := 1; i < classes; i++ {
+			breaks[i] = round(min * math.Pow(ratio, float64(i)))
+		}
+	case "jenks":
+		for i, start := range jenksClasses(values, classes) {
+			breaks[i] = values[start]
+		}
+	default:
+		return nil, fmt.Errorf("classification: unknown method '%s'", method)
+	}
+
+	if !whole {
+		for i := range breaks {
+			breaks[i] = roundDown(breaks[i], 3)
+		}
+	}
+	// every break must be above the one before, or the class is empty
+	for i := 1; i < len(breaks); i++ {
+		if breaks[i] < breaks[i-1] {
+			breaks[i] = breaks[i-1]
+		}
+	}
+	return breaks, nil
+}
+
+// round down to n significant figures
+func roundDown(v float64, n int) float64 {
+	if v <= 0 {
+		return v
+	}
+	p := math.Pow(10, float64(n)-math.Ceil(math.Log10(v)))
+	// the small allowance keeps exact values from dropping a step
+	return math.Floor(v*p+1e-9) / p
+}
+
+// Jenks natural breaks (Fisher's exact optimization): split sorted values
+// into classes minimizing the total within-class squared deviation. Returns
+// the index in values where each class starts.
+func jenksClasses(values []float64, classes int) []int {
+	n := len(values)
+
+	// lower[i][k]: start (1-based) of the last class in the best split of
+	// the first i values into k classes; variance[i][k]: its cost
+	lower := make([][]int, n+1)
+	variance := make([][]float64, n+1)
+	for i := range lower {
+		lower[i] = make([]int, classes+1)
+		variance[i] = make([]float64, classes+1)
+		for k := range variance[i] {
+			variance[i][k] = math.Inf(1)
+		}
+	}
+	for k := 1; k <= classes; k++ {
+		lower[1][k] = 1
+		variance[1][k] = 0
+	}
+
+	for i := 2; i <= n; i++ {
+		var sum, sumSquares, count float64
+		v := 0.0
+		for m := 1; m <= i; m++ {
+			// values[lowerClassLimit-1 .. i-1] form the last class
+			lowerClassLimit := i - m + 1
+			val := values[lowerClassLimit-1]
+			count++
+			sum += val
+			sumSquares += val * val
+			v = sumSquares - sum*sum/count
+			if lowerClassLimit > 1 {
+				for k := 2; k <= classes; k++ {
+					if cost := v + variance[lowerClassLimit-1][k-1]; cost <= variance[i][k] {
+						lower[i][k] = lowerClassLimit
+						variance[i][k] = cost
+					}
+				}
+			}
+		}
+		lower[i][1] = 1
+		variance[i][1] = v
+	}
+
+	starts := make([]int, classes)
+	k := n
+	for j := classes; j >= 1; j-- {
+		starts[j-1] = lower[k][j] - 1
+		k = lower[k][j] - 1
+		if k < 1 {
+			k = 1
+		}
+	}
+	return starts
+}
+
+// pick n colours from a palette, spread evenly and keeping both ends
+func spreadPalette(palette []string, n int) []string {
+	if n >= len(palette) {
+		return palette
+	}
+	if n == 1 {
+		return palette[:1]
+	}
+	out := make([]string, n)
+	for i := range out {
+		out[i] = palette[int(math.Round(float64(i)*float64(len(palette)-1)/float64(n-1)))]
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package render
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+)
+
+func TestClassBreaks(t *testing.T) {
+	tens := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	clusters := []float64{1, 2, 3, 10, 11, 12, 20, 21, 22}
+	for _, tc := range []struct {
+		method  string
+		values  []float64
+		classes int
+		want    []float64
+	}{
+		{"quantile", tens, 5, []float64{1, 3, 5, 7, 9}},
+		{"equal", tens, 5, []float64{1, 3, 5, 7, 9}},
+		{"geometric", tens, 5, []float64{1, 2, 3, 4, 7}},
+		{"jenks", clusters, 3, []float64{1, 10, 20}},
+		{"quantile", clusters, 3, []float64{1, 10, 20}},
+		// decimals are rounded down to three significant figures
+		{"equal", []float64{0.5, 1.25, 2.125, 3.5}, 2, []float64{0.5, 2}},
+		{"geometric", []float64{0.01, 0.1, 1}, 2, []float64{0.01, 0.1}},
+		// no more classes than values
+		{"quantile", []float64{4, 8}, 5, []float64{4, 8}},
+		{"equal", nil, 3, nil},
+		// breaks that collapse stay in order
+		{"quantile", []float64{5, 5, 5, 5, 6}, 3, []float64{5, 5, 5}},
+	} {
+		got, err := classBreaks(tc.values, tc.classes, tc.method)
+		if err != nil {
+			t.Errorf("%s %v: %v", tc.method, tc.values, err)
+		} else if !slices.Equal(got, tc.want) {
+			t.Errorf("%s %v into %d: got %v, want %v", tc.method, tc.values, tc.classes, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		method string
+		values []float64
+	}{
+		{"geometric", []float64{0, 5, 10}},
+		{"geometric", []float64{-5, 5, 10}},
+		{"natural", tens},
+	} {
+		if got, err := classBreaks(tc.values, 3, tc.method); err == nil {
+			t.Errorf("%s %v: got %v, want an error", tc.method, tc.values, got)
+		}
+	}
+}
+
+func TestJenksClasses(t *testing.T) {
+	for _, tc := range []struct {
+		values  []float64
+		classes int
+		want    []int
+	}{
+		{[]float64{1, 2, 3, 10, 11, 12, 20, 21, 22}, 3, []int{0, 3, 6}},
+		{[]float64{1, 1, 1, 50, 100, 101, 102}, 3, []int{0, 3, 4}},
+		{[]float64{1, 2, 3, 4}, 1, []int{0}},
+		{[]float64{1, 2, 3, 4}, 4, []int{0, 1, 2, 3}},
+	} {
+		if got := jenksClasses(tc.values, tc.classes); !slices.Equal(got, tc.want) {
+			t.Errorf("%v into %d: got %v, want %v", tc.values, tc.classes, got, tc.want)
+		}
+	}
+}
+
+func TestClassifyColours(t *testing.T) {
+	palette := []string{"ffffb2", "fd8d3c", "bd0026"}
+	colours, err := ClassifyColours(map[string]float64{"a": 1, "b": 2, "c": 10, "d": 11, "e": 0}, config.Classification{Method: "jenks", Palette: palette})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(colours) != 3 || colours["1"] != "ffffb2" || colours["2"] != "fd8d3c" || colours["10"] != "bd0026" {
+		t.Errorf("got %v", colours)
+	}
+
+	// everything in one class
+	if colours, err := ClassifyColours(map[string]float64{"a": 5, "b": 5, "c": 5, "d": 5}, config.Classification{Method: "quantile", Palette: palette}); err == nil {
+		t.Errorf("got %v, want an error", colours)
+	}
+}
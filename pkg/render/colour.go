@@ -0,0 +1,349 @@
+package render
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"slices"
+	"strconv"
+	s "strings"
+)
+
+// Scale maps values to fill colours, either stepped (each region gets the
+// colour of the highest minimum it meets) or as a gradient between the same
+// minimums used as colour stops.
+type Scale struct {
+	mincount []float64
+	colours  []string
+	gradient bool
+	space    string
+
+	// whether the values are all whole numbers, and the decimal places for
+	// legend labels (-1 for as many as each needs)
+	whole    bool
+	decimals int
+}
+
+// NewScale makes a scale from a colours section (minimum -> colour), a
+// colour_mode ("steps" or "gradient") and a colour_space (for gradients:
+// "rgb", "hsl" or "lab").
+func NewScale(colours map[string]string, mode, space string) (*Scale, error) {
+	scale := &Scale{
+		space:    s.ToLower(space),
+		whole:    true,
+		decimals: -1,
+	}
+
+	switch s.ToLower(mode) {
+	case "", "steps":
+	case "gradient":
+		scale.gradient = true
+	default:
+		return nil, fmt.Errorf("unknown colour_mode '%s'", mode)
+	}
+
+	switch scale.space {
+	case "":
+		scale.space = "rgb"
+	case "rgb", "hsl", "lab":
+	default:
+		return nil, fmt.Errorf("unknown colour_space '%s'", space)
+	}
+
+	// make sorted list of keys (minimums) for later comparisons
+	byMin := make(map[float64]string)
+	for k, v := range colours {
+		k_f, err := parseMinimum(k)
+		if err != nil {
+			return nil, fmt.Errorf("colours: '%s' is not a number", k)
+		}
+		if _, err := parseHexColour(v); err != nil {
+			return nil, fmt.Errorf("colours: %s: %v", k, err)
+		}
+		scale.mincount = append(scale.mincount, k_f)
+		byMin[k_f] = s.ToLower(s.TrimPrefix(v, "#"))
+	}
+	slices.Sort(scale.mincount)
+	scale.mincount = slices.Compact(scale.mincount)
+	for _, mc := range scale.mincount {
+		scale.colours = append(scale.colours, byMin[mc])
+	}
+
+	if scale.gradient && len(scale.mincount) < 2 {
+		return nil, fmt.Errorf("colour_mode gradient needs at least two colours")
+	}
+
+	return scale, nil
+}
+
+// a colours key: an integer (in any base strconv understands) or a decimal
+func parseMinimum(k string) (float64, error) {
+	if k_i, err := strconv.ParseInt(k, 0, 64); err == nil {
+		return float64(k_i), nil
+	}
+	return strconv.ParseFloat(k, 64)
+}
+
+// the step (or gradient stop) a value falls in; -1 if it's below every
+// minimum
+func (scale *Scale) class(value float64) int {
+	i, found := slices.BinarySearch(scale.mincount, value)
+	if !found {
+		i--
+	}
+	return i
+}
+
+// Colour gives the fill colour (as 6 hex digits) for a value; false if it's
+// below every minimum.
+func (scale *Scale) Colour(value float64) (string, bool) {
+	i := scale.class(value)
+	if i < 0 {
+		return "", false
+	}
+
+	mc := scale.mincount[i]
+	if !scale.gradient || i == len(scale.mincount)-1 {
+		return scale.colours[i], true
+	}
+
+	next := scale.mincount[i+1]
+	t := (value - mc) / (next - mc)
+	return scale.between(i, t), true
+}
+
+// colour at fraction t of the way from stop i to stop i+1
+func (scale *Scale) between(i int, t float64) string {
+	from, _ := parseHexColour(scale.colours[i])
+	to, _ := parseHexColour(scale.colours[i+1])
+	return interpolateColour(from, to, t, scale.space).hex()
+}
+
+// colour at fraction t along a legend ramp, where the stops are evenly spaced
+func (scale *Scale) ramp(t float64) string {
+	segments := float64(len(scale.mincount) - 1)
+	pos := math.Max(0, math.Min(1, t)) * segments
+	i := int(math.Floor(pos))
+	if i >= len(scale.mincount)-1 {
+		return scale.colours[len(scale.colours)-1]
+	}
+	return scale.between(i, pos-float64(i))
+}
+
+// legend label for stop (or step) i. Whole-number steps of whole-number
+// values show their last value ("3-9"); others run up to the next minimum
+// ("0.5-1.2").
+func (scale *Scale) label(i int) string {
+	mc := scale.mincount[i]
+	label := FormatNumber(mc, scale.decimals)
+	if i == len(scale.mincount)-1 {
+		return label + "+"
+	} else if scale.gradient {
+		return label
+	}
+
+	next := scale.mincount[i+1]
+	if scale.whole && mc == math.Trunc(mc) && next == math.Trunc(next) {
+		if next != mc+1 {
+			label = label + "-" + FormatNumber(next-1, scale.decimals)
+		}
+		return label
+	}
+	return label + "-" + FormatNumber(next, scale.decimals)
+}
+
+// a value as briefly as it can be written
+func formatValue(v float64) string {
+	return FormatNumber(v, -1)
+}
+
+// FormatNumber writes a value with the given number of decimal places, or
+// with as many as it needs if that's negative (ignoring the noise adding up
+// decimals leaves).
+func FormatNumber(v float64, decimals int) string {
+	if decimals < 0 {
+		return strconv.FormatFloat(math.Round(v*1e9)/1e9, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'f', decimals, 64)
+}
+
+// whether every value is a whole number
+func wholeValues(values map[string]float64) bool {
+	for _, v := range values {
+		if v != math.Trunc(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// a normalized value for people to read
+func formatRate(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// RGB with components 0..1
+type rgb struct {
+	r, g, b float64
+}
+
+func parseHexColour(hex string) (rgb, error) {
+	hex = s.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return rgb{}, fmt.Errorf("colour '%s' is not 6 hex digits", hex)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return rgb{}, fmt.Errorf("colour '%s' is not 6 hex digits", hex)
+	}
+	return rgb{
+		float64(v>>16&0xff) / 255,
+		float64(v>>8&0xff) / 255,
+		float64(v&0xff) / 255,
+	}, nil
+}
+
+func (c rgb) rgba() color.RGBA {
+	component := func(v float64) uint8 {
+		return uint8(math.Round(math.Max(0, math.Min(1, v)) * 255))
+	}
+	return color.RGBA{component(c.r), component(c.g), component(c.b), 255}
+}
+
+func (c rgb) hex() string {
+	rgba := c.rgba()
+	return fmt.Sprintf("%02x%02x%02x", rgba.R, rgba.G, rgba.B)
+}
+
+func interpolateColour(from, to rgb, t float64, space string) rgb {
+	lerp := func(a, b float64) float64 {
+		return a + (b-a)*t
+	}
+
+	switch space {
+	case "hsl":
+		h1, s1, l1 := from.hsl()
+		h2, s2, l2 := to.hsl()
+		// go the short way around the hue circle; greys have no hue
+		if s1 == 0 {
+			h1 = h2
+		} else if s2 == 0 {
+			h2 = h1
+		}
+		if h2-h1 > 180 {
+			h1 += 360
+		} else if h1-h2 > 180 {
+			h2 += 360
+		}
+		return hslToRgb(math.Mod(lerp(h1, h2), 360), lerp(s1, s2), lerp(l1, l2))
+	case "lab":
+		L1, a1, b1 := from.lab()
+		L2, a2, b2 := to.lab()
+		return labToRgb(lerp(L1, L2), lerp(a1, a2), lerp(b1, b2))
+	}
+
+	return rgb{lerp(from.r, to.r), lerp(from.g, to.g), lerp(from.b, to.b)}
+}
+
+// hue in degrees, saturation and lightness 0..1
+func (c rgb) hsl() (float64, float64, float64) {
+	max := math.Max(c.r, math.Max(c.g, c.b))
+	min := math.Min(c.r, math.Min(c.g, c.b))
+	l := (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+
+	d := max - min
+	sat := d / (1 - math.Abs(2*l-1))
+	var h float64
+	switch max {
+	case c.r:
+		h = math.Mod((c.g-c.b)/d, 6)
+	case c.g:
+		h = (c.b-c.r)/d + 2
+	default:
+		h = (c.r-c.g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, sat, l
+}
+
+func hslToRgb(h, sat, l float64) rgb {
+	c := (1 - math.Abs(2*l-1)) * sat
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return rgb{r + m, g + m, b + m}
+}
+
+// CIE L*a*b* (D65) via linear sRGB and XYZ
+func (c rgb) lab() (float64, float64, float64) {
+	linear := func(v float64) float64 {
+		if v <= 0.04045 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	r, g, b := linear(c.r), linear(c.g), linear(c.b)
+
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / 0.95047
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389.0 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27.0*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+func labToRgb(L, a, b float64) rgb {
+	fy := (L + 16) / 116
+	fx := fy + a/500
+	fz := fy - b/200
+
+	finv := func(t float64) float64 {
+		if t*t*t > 216.0/24389.0 {
+			return t * t * t
+		}
+		return (116*t - 16) / (24389.0 / 27.0)
+	}
+	x := finv(fx) * 0.95047
+	y := finv(fy)
+	z := finv(fz) * 1.08883
+
+	gamma := func(v float64) float64 {
+		if v <= 0.0031308 {
+			return 12.92 * v
+		}
+		return 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return rgb{
+		gamma(3.2404542*x - 1.5371385*y - 0.4985314*z),
+		gamma(-0.9692660*x + 1.8760108*y + 0.0415560*z),
+		gamma(0.0556434*x - 0.2040259*y + 1.0572252*z),
+	}
+}
@@ -0,0 +1,582 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"os/exec"
+	"reflect"
+	re "regexp"
+	"slices"
+	"strconv"
+	s "strings"
+	"time"
+
+	"github.com/golang/freetype"
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/svgxml"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	re_fill   = re.MustCompile(`(fill:#)......`)
+	re_stroke = re.MustCompile(`(^|;)\s*stroke(-width)?\s*:[^;]*`)
+)
+
+// going to call ImageMagick's 'convert' because I couldn't find a damn SVG
+// package that can write to a non-SVG image (the builtin rasterizer covers
+// most maps now, but this is still here for anything it can't handle)
+func imagemagickRaster(svgData []byte, imagemagick, size string) (*image.RGBA, error) {
+	if len(imagemagick) == 0 {
+		imagemagick = "convert"
+	}
+	cmd := exec.Command(imagemagick, "svg:-", "-resize", size, "png:-")
+	cmd.Stdin = bytes.NewReader(svgData)
+
+	// grab PNG data and cram it into an RGBA image
+	png_data, err := cmd.Output()
+	if err != nil {
+		log.Debugf("%s svg:- -resize %s png:-", imagemagick, size)
+		return nil, fmt.Errorf("read from convert: %v", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(png_data))
+	if err != nil {
+		return nil, fmt.Errorf("decode convert output: %v", err)
+	}
+	b := img.Bounds()
+	imgRbga := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(imgRbga, imgRbga.Bounds(), img, b.Min, draw.Src)
+
+	return imgRbga, nil
+}
+
+// colour each region by its value; titles get the tally
+func colourSvgData(svg *svgxml.SVG, data map[string]float64, values map[string]float64, scale *Scale, attrs config.MapSet) ([]string, error) {
+	var errors []string
+
+	for id, count := range data {
+		value, ok := values[id]
+		if !ok {
+			continue
+		}
+		fill, ok := scale.Colour(value)
+		if !ok {
+			continue
+		}
+		e, err := svg.FindPathsById(id, svgxml.FindFirst)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 0 && e[0] != nil {
+			element := e[0]
+			element.Style = re_fill.ReplaceAllString(element.Style, "${1}"+fill)
+			element.Title = s.TrimLeft(fmt.Sprintf("%s (%s)", element.Title, formatValue(count)), " ")
+		} else {
+			var ignoreMe bool
+			if _, ok := attrs.IgnoreMissing[id]; ok {
+				ignoreMe = attrs.IgnoreMissing[id]
+			}
+			if !ignoreMe {
+				errors = append(errors, "'"+id+"' not found")
+			}
+		}
+	}
+	return errors, nil
+}
+
+// give the new regions the delta fill and/or outline (a red outline if
+// neither is set)
+func highlightRegions(svg *svgxml.SVG, ids []string, delta config.DeltaParams) error {
+	outline := s.TrimPrefix(delta.Outline, "#")
+	width := delta.OutlineWidth
+	if len(delta.Colour) == 0 && len(outline) == 0 {
+		outline = "ff0000"
+	}
+	if width == 0 {
+		width = 2
+	}
+
+	for _, id := range ids {
+		e, err := svg.FindPathsById(id, svgxml.FindFirst)
+		if err != nil {
+			return err
+		}
+		if len(e) == 0 || e[0] == nil {
+			continue
+		}
+		element := e[0]
+		if len(delta.Colour) > 0 {
+			element.Style = re_fill.ReplaceAllString(element.Style, "${1}"+s.TrimPrefix(delta.Colour, "#"))
+		}
+		if len(outline) > 0 {
+			style := s.Trim(re_stroke.ReplaceAllString(element.Style, ""), ";")
+			element.Style = s.TrimLeft(fmt.Sprintf("%s;stroke:#%s;stroke-width:%d", style, outline, width), ";")
+		}
+	}
+	return nil
+}
+
+// DecimalPlaces gives the decimal places for legend labels or annotation
+// tallies: the map's own setting, else the default one, else -1 (as many as
+// each number needs).
+func DecimalPlaces(defaults, own []int) int {
+	if len(own) > 0 {
+		return own[0]
+	} else if len(defaults) > 0 {
+		return defaults[0]
+	}
+	return -1
+}
+
+func annotate(img any, defaults config.LegendAnnotateParams, attrs config.MapSet, data map[string]float64) error {
+	var (
+		imgRgba     *image.RGBA
+		imgSvg      *svgxml.SVG
+		imgTypeStr  string
+		lineSpacing int
+	)
+
+	imgType := reflect.TypeOf(img)
+	if imgType == reflect.TypeFor[*image.RGBA]() {
+		imgTypeStr = "rgb"
+		imgRgba = img.(*image.RGBA)
+	} else if imgType == reflect.TypeFor[*svgxml.SVG]() {
+		imgTypeStr = "svg"
+		imgSvg = img.(*svgxml.SVG)
+	} else {
+		return fmt.Errorf("annotate(): unknown image type '%s'", imgType.String())
+	}
+
+	annX := defaults.AnnotationX
+	annY := defaults.AnnotationY
+	timefmt := defaults.AnnotationTimeFmt
+	fontFile := defaults.AnnotationFontFile
+	fontSize := defaults.AnnotationFontSize
+	textStyle := defaults.AnnotationTextStyle
+
+	if len(defaults.AnnotationSpacing) > 0 {
+		lineSpacing = defaults.AnnotationSpacing[0]
+	}
+	if attrs.LegendAnnotate.AnnotationX > 0 {
+		annX = attrs.LegendAnnotate.AnnotationX
+	}
+	if attrs.LegendAnnotate.AnnotationY > 0 {
+		annY = attrs.LegendAnnotate.AnnotationY
+	}
+	if len(attrs.LegendAnnotate.AnnotationFontFile) > 0 {
+		fontFile = attrs.LegendAnnotate.AnnotationFontFile
+	}
+	if attrs.LegendAnnotate.AnnotationFontSize > 0 {
+		fontSize = attrs.LegendAnnotate.AnnotationFontSize
+	}
+	if len(attrs.LegendAnnotate.AnnotationTimeFmt) > 0 {
+		timefmt = attrs.LegendAnnotate.AnnotationTimeFmt
+	}
+	if len(attrs.LegendAnnotate.AnnotationSpacing) > 0 {
+		lineSpacing = attrs.LegendAnnotate.AnnotationSpacing[0]
+	}
+
+	if len(attrs.LegendAnnotate.AnnotationTextStyle) > 0 {
+		textStyle = attrs.LegendAnnotate.AnnotationTextStyle
+	}
+	textStyle = s.TrimLeft(fmt.Sprintf("%s;font-size:%.2fpx", textStyle, fontSize), ";")
+	// a copy, so the config's lines keep their placeholders for the next map
+	annLines := slices.Clone(attrs.LegendAnnotate.Annotation)
+
+	total_hits := 0.0
+	for _, hits := range data {
+		total_hits += hits
+	}
+	decimals := DecimalPlaces(defaults.AnnotationDecimals, attrs.LegendAnnotate.AnnotationDecimals)
+	regions := len(data)
+	if attrs.RegionAdjustment != 0 {
+		regions += attrs.RegionAdjustment
+	}
+
+	for i, line := range annLines {
+		annLines[i] = s.ReplaceAll(
+			s.ReplaceAll(
+				s.ReplaceAll(line, "%t%", FormatNumber(total_hits, decimals)),
+				"%c%", strconv.Itoa(regions),
+			),
+			"%T%", time.Now().Format(timefmt))
+	}
+
+	if len(annLines) == 0 {
+		return nil
+	}
+
+	if imgTypeStr == "rgb" {
+		fontdata, err := os.ReadFile(fontFile)
+		if err != nil {
+			return fmt.Errorf("annotate(): read font file '%s': %v", fontFile, err)
+		}
+		font, err := freetype.ParseFont(fontdata)
+		if err != nil {
+			return fmt.Errorf("annotate(): ParseFont(): %v", err)
+		}
+
+		fontCtx := freetype.NewContext()
+		fontCtx.SetDPI(72.0)
+		fontCtx.SetFont(font)
+		fontCtx.SetFontSize(fontSize)
+		fontCtx.SetClip(imgRgba.Bounds())
+		fontCtx.SetDst(imgRgba)
+		fontCtx.SetSrc(image.Black)
+		pt := freetype.Pt(int(annX), int(annY)+int(fontCtx.PointToFixed(fontSize)>>6))
+
+		for _, line := range annLines {
+			_, err = fontCtx.DrawString(line, pt)
+			if err != nil {
+				return fmt.Errorf("annotate(): fontCtx.DrawString(): %v", err)
+			}
+			pt.Y += fontCtx.PointToFixed(fontSize * 1.2)
+		}
+	} else if imgTypeStr == "svg" {
+		annotationDef := svgxml.TextDef{
+			Id:    "Annotation",
+			Style: textStyle,
+			X:     strconv.Itoa(annX),
+			Y:     strconv.Itoa(annY),
+		}
+		for i, line := range annLines {
+			if line == "" {
+				continue
+			}
+			if s.Index(line, " ") == 0 {
+				spaces := len(line) - len(s.TrimLeft(line, " "))
+				line = s.Replace(line, " ", "\u00A0", spaces)
+			}
+			annotationDef.TSpan = append(annotationDef.TSpan, svgxml.TSpanDef{
+				Id:    fmt.Sprintf("AnnotationSpan_%d", i),
+				X:     strconv.Itoa(annX),
+				Y:     strconv.Itoa(annY + int(float64(i)*(fontSize+float64(lineSpacing)))),
+				Label: line,
+			})
+			if len(imgSvg.Text) == 0 {
+				imgSvg.Text = make([]svgxml.TextDef, 0)
+			}
+		}
+		imgSvg.Text = append(imgSvg.Text, annotationDef)
+	}
+
+	log.Debugf("annotate(): done with %s image", imgTypeStr)
+	return nil
+}
+
+func ahHatesLegends(img any, scale *Scale, defaults config.LegendAnnotateParams, attrs config.MapSet) error {
+	var (
+		textXOffset int
+		textYOffset int
+		imgRgba     *image.RGBA
+		imgSvg      *svgxml.SVG
+		imgTypeStr  string
+	)
+
+	imgType := reflect.TypeOf(img)
+	if imgType == reflect.TypeFor[*image.RGBA]() {
+		imgTypeStr = "rgb"
+		imgRgba = img.(*image.RGBA)
+	} else if imgType == reflect.TypeFor[*svgxml.SVG]() {
+		imgTypeStr = "svg"
+		imgSvg = img.(*svgxml.SVG)
+	} else {
+		return fmt.Errorf("ahHatesLegends(): unknown image type '%s'", imgType.String())
+	}
+
+	fontFile := defaults.LegendFontFile
+	fontSize := defaults.LegendFontSize
+	gravity := defaults.LegendGravity
+	orient := defaults.LegendOrient
+	cellW := defaults.LegendCellWidth
+	cellH := defaults.LegendCellHeight
+	cellGap := defaults.LegendCellGap
+	legendX := -1
+	legendY := -1
+
+	if len(defaults.LegendTextXOffset) > 0 {
+		textXOffset = defaults.LegendTextXOffset[0]
+	}
+	if len(defaults.LegendTextYOffset) > 0 {
+		textYOffset = defaults.LegendTextYOffset[0]
+	}
+
+	if len(defaults.LegendX) > 0 {
+		legendX = defaults.LegendX[0]
+	}
+	if len(defaults.LegendY) > 0 {
+		legendY = defaults.LegendY[0]
+	}
+
+	if len(attrs.LegendAnnotate.LegendFontFile) > 0 {
+		fontFile = attrs.LegendAnnotate.LegendFontFile
+	}
+
+	if attrs.LegendAnnotate.LegendFontSize > 0 {
+		fontSize = attrs.LegendAnnotate.LegendFontSize
+	}
+
+	if len(attrs.LegendAnnotate.LegendGravity) > 0 {
+		gravity = attrs.LegendAnnotate.LegendGravity
+	}
+
+	if len(attrs.LegendAnnotate.LegendX) > 0 {
+		legendX = attrs.LegendAnnotate.LegendX[0]
+	}
+	if len(attrs.LegendAnnotate.LegendY) > 0 {
+		legendY = attrs.LegendAnnotate.LegendY[0]
+	}
+
+	if len(scale.mincount) == 0 {
+		log.Debug("ahHatesLegends(): no colours to show")
+		return nil
+	}
+
+	// if gravity isn't used (empty or "-") and X and/or Y coord is not given, skip legend
+	if (gravity == "-" || gravity == "") && (legendX < 0 || legendY < 0) {
+		log.Debug("ahHatesLegends(): missing gravity with incomplete X/Y coordinate")
+		return nil
+	}
+
+	if len(attrs.LegendAnnotate.LegendOrient) > 0 {
+		orient = attrs.LegendAnnotate.LegendOrient
+	}
+	if attrs.LegendAnnotate.LegendCellWidth > 0 {
+		cellW = attrs.LegendAnnotate.LegendCellWidth
+	}
+	if attrs.LegendAnnotate.LegendCellHeight > 0 {
+		cellH = attrs.LegendAnnotate.LegendCellHeight
+	}
+	if attrs.LegendAnnotate.LegendCellGap > 0 {
+		cellGap = attrs.LegendAnnotate.LegendCellGap
+	}
+	if len(attrs.LegendAnnotate.LegendTextXOffset) > 0 {
+		textXOffset = attrs.LegendAnnotate.LegendTextXOffset[0]
+	}
+	if len(attrs.LegendAnnotate.LegendTextYOffset) > 0 {
+		textYOffset = attrs.LegendAnnotate.LegendTextYOffset[0]
+	}
+
+	switch imgTypeStr {
+	case "rgb":
+		fontdata, err := os.ReadFile(fontFile)
+		if err != nil {
+			return fmt.Errorf("ahHatesLegends(): read font file '%s': %v", fontFile, err)
+		}
+		font, err := freetype.ParseFont(fontdata)
+		if err != nil {
+			return fmt.Errorf("ahHatesLegends(): ParseFont(): %v", err)
+		}
+		b := imgRgba.Bounds()
+		fontCtx := freetype.NewContext()
+		fontCtx.SetDPI(72.0)
+		fontCtx.SetFont(font)
+		fontCtx.SetFontSize(fontSize)
+		fontCtx.SetClip(b)
+		fontCtx.SetDst(imgRgba)
+		fontCtx.SetSrc(image.Black)
+
+		legendWidth := cellW
+		legendHeight := cellH
+		if orient == "vertical" {
+			legendHeight = len(scale.mincount)*(cellH+cellGap) - cellGap
+		} else {
+			legendWidth = len(scale.mincount)*(cellW+cellGap) - cellGap
+		}
+
+		boxX := 0
+		boxY := 0
+		log.Debugf("gravity: %s; coords: %dx%d", gravity, legendX, legendY)
+		if gravity == "-" {
+			boxX = legendX
+			boxY = legendY
+		} else {
+			if s.ToLower(gravity)[0] == 's' {
+				boxY = b.Dy() - legendHeight
+			}
+			if s.ToLower(gravity)[1] == 'e' {
+				boxX = b.Dx() - legendWidth
+			}
+		}
+
+		if scale.gradient {
+			// one continuous bar with the stops where the cells would start
+			for _, slice := range legendRamp(scale, orient, boxX, boxY, cellW, cellH, cellGap, 1) {
+				draw.Draw(imgRgba, slice.rect, &image.Uniform{slice.fill.rgba()}, image.Pt(0, 0), draw.Src)
+			}
+		}
+
+		for i := range scale.mincount {
+			if !scale.gradient {
+				fill, _ := parseHexColour(scale.colours[i])
+				draw.Draw(imgRgba, image.Rect(boxX, boxY, boxX+cellW, boxY+cellH),
+					&image.Uniform{fill.rgba()}, image.Pt(0, 0), draw.Src)
+			}
+			if orient == "vertical" {
+				boxY += cellH + cellGap
+			} else {
+				boxX += cellW + cellGap
+			}
+
+			label := scale.label(i)
+			var textX, textY int
+			if orient == "vertical" {
+				textX = boxX + 4
+				textY = boxY - cellH + int(fontCtx.PointToFixed(fontSize)>>6)
+			} else {
+				textX = boxX - cellW + 4
+				textY = boxY + int(fontCtx.PointToFixed(fontSize)>>6)
+			}
+			fpt := freetype.Pt(textX, textY)
+			_, err = fontCtx.DrawString(label, fpt)
+			if err != nil {
+				return fmt.Errorf("ahHatesLegends(): fontCtx.DrawString(): %v", err)
+			}
+		}
+	case "svg":
+		log.Debugf("svg starting legend coords: %dx%d", legendX, legendY)
+		if gravity != "-" {
+			log.Debugf("legend gravity specified for svg: %s", gravity)
+
+			imgHeight, _ := strconv.Atoi(imgSvg.Height)
+			imgWidth, _ := strconv.Atoi(imgSvg.Width)
+			log.Debugf("svg image dim: %dx%d", imgWidth, imgHeight)
+
+			if s.ToLower(gravity)[0] == 's' {
+				if orient == "horizontal" {
+					legendY = imgHeight - cellH
+				} else {
+					legendY = imgHeight - (len(scale.mincount)*(cellH+cellGap) - cellGap)
+				}
+			} else {
+				legendY = 0
+			}
+			if s.ToLower(gravity)[1] == 'e' {
+				if orient == "horizontal" {
+					legendX = imgWidth - (len(scale.mincount)*(cellW+cellGap) - cellGap)
+				} else {
+					legendX = imgWidth - cellW
+				}
+			} else {
+				legendX = 0
+			}
+		}
+		log.Debugf("svg final legend coords:    %dx%d", legendX, legendY)
+		if len(imgSvg.Text) == 0 {
+			imgSvg.Text = make([]svgxml.TextDef, 0)
+		}
+		legendTextStyle := defaults.LegendTextStyle
+		if len(attrs.LegendAnnotate.LegendTextStyle) > 0 {
+			legendTextStyle = attrs.LegendAnnotate.LegendTextStyle
+		}
+		if len(legendTextStyle) > 0 {
+			legendTextStyle += ";"
+		}
+		legendTextStyle += fmt.Sprintf("font-size:%.2fpx", fontSize)
+		rects := make([]svgxml.RectDef, 0)
+		if scale.gradient {
+			// one continuous bar (in 2px slices) with the stops where the
+			// cells would start
+			for j, slice := range legendRamp(scale, orient, legendX, legendY, cellW, cellH, cellGap, 2) {
+				rects = append(rects, svgxml.RectDef{
+					Id:     "LegendRamp" + strconv.Itoa(j),
+					Style:  "fill:#" + slice.fill.hex(),
+					X:      strconv.Itoa(slice.rect.Min.X),
+					Width:  strconv.Itoa(slice.rect.Dx()),
+					Y:      strconv.Itoa(slice.rect.Min.Y),
+					Height: strconv.Itoa(slice.rect.Dy()),
+				})
+			}
+		}
+		for i := range scale.mincount {
+			var (
+				xCoord int
+				yCoord int
+			)
+			if orient == "vertical" {
+				xCoord = legendX
+				yCoord = legendY + i*(cellH+cellGap)
+			} else {
+				xCoord = legendX + i*(cellW+cellGap)
+				yCoord = legendY
+			}
+			if !scale.gradient {
+				newRect := svgxml.RectDef{
+					Id:     "Legend" + strconv.Itoa(i),
+					Style:  "fill:#" + scale.colours[i],
+					X:      strconv.Itoa(xCoord),
+					Width:  strconv.Itoa(cellW),
+					Y:      strconv.Itoa(yCoord),
+					Height: strconv.Itoa(cellH),
+				}
+				rects = append(rects, newRect)
+			}
+
+			label := scale.label(i)
+			newText := svgxml.TextDef{
+				Id:    "LegendText" + strconv.Itoa(i),
+				X:     strconv.Itoa(xCoord + textXOffset),
+				Y:     strconv.Itoa(yCoord + int(fontSize) + textYOffset),
+				Style: legendTextStyle,
+				TSpan: []svgxml.TSpanDef{
+					{
+						Id:    "LegendSpan" + strconv.Itoa(i),
+						Label: label,
+						X:     strconv.Itoa(xCoord + textXOffset),
+						Y:     strconv.Itoa(yCoord + int(fontSize) + textYOffset),
+					},
+				},
+			}
+			imgSvg.Text = append(imgSvg.Text, newText)
+		}
+		if len(imgSvg.G) == 0 {
+			imgSvg.G = make([]svgxml.GroupDef, 0)
+		}
+		imgSvg.G = append(imgSvg.G, svgxml.GroupDef{Rect: rects})
+	}
+	return nil
+}
+
+type rampSlice struct {
+	rect image.Rectangle
+	fill rgb
+}
+
+// slices (of the given thickness) of a gradient legend bar covering the same
+// area as the stepped legend's cells, with each colour stop at the start of
+// its cell and the last cell in the last colour, plus tick marks at the stops
+func legendRamp(scale *Scale, orient string, x, y, cellW, cellH, cellGap, thickness int) []rampSlice {
+	var ramp []rampSlice
+
+	stopGap := cellW + cellGap
+	length := len(scale.mincount)*stopGap - cellGap
+	if orient == "vertical" {
+		stopGap = cellH + cellGap
+		length = len(scale.mincount)*stopGap - cellGap
+	}
+	rampLength := float64((len(scale.mincount) - 1) * stopGap)
+
+	for p := 0; p < length; p += thickness {
+		end := min(p+thickness, length)
+		fill, _ := parseHexColour(scale.ramp(float64(p+end-1) / 2 / rampLength))
+		if orient == "vertical" {
+			ramp = append(ramp, rampSlice{image.Rect(x, y+p, x+cellW, y+end), fill})
+		} else {
+			ramp = append(ramp, rampSlice{image.Rect(x+p, y, x+end, y+cellH), fill})
+		}
+	}
+
+	black := rgb{0, 0, 0}
+	for i := 1; i < len(scale.mincount); i++ {
+		p := i * stopGap
+		if orient == "vertical" {
+			ramp = append(ramp, rampSlice{image.Rect(x, y+p, x+3, y+p+1), black})
+		} else {
+			ramp = append(ramp, rampSlice{image.Rect(x+p, y, x+p+1, y+3), black})
+		}
+	}
+
+	return ramp
+}
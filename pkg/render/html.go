@@ -0,0 +1,174 @@
+package render
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"path/filepath"
+	s "strings"
+
+	"github.com/jeff-blank/svgxml"
+)
+
+// what the page's script knows about each region with data
+type htmlRegion struct {
+	Name  string  `json:"name"`
+	Tally float64 `json:"tally"`
+	Value string  `json:"value,omitempty"`
+	Class int     `json:"class"`
+	Url   string  `json:"url,omitempty"`
+}
+
+type htmlLegendEntry struct {
+	Colour string
+	Label  string
+}
+
+var htmlTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+#map svg { max-width: 100%; height: auto; }
+#map .region:hover { stroke: #000 !important; stroke-width: 2px !important; filter: brightness(0.9); }
+#map .region.link { cursor: pointer; }
+#map .region.dimmed { opacity: 0.2; }
+#legend { margin-top: 0.5em; }
+#legend button { font: inherit; border: 1px solid #888; background: #fff; margin: 0 0.25em 0.25em 0; padding: 0.1em 0.5em; cursor: pointer; }
+#legend button.active { border-color: #000; box-shadow: inset 0 0 0 1px #000; }
+#legend .swatch { display: inline-block; width: 1em; height: 1em; margin-right: 0.4em; vertical-align: -0.15em; border: 1px solid #888; }
+#tooltip { position: absolute; pointer-events: none; background: #fff; border: 1px solid #888; padding: 0.2em 0.5em; font-size: 0.9em; white-space: nowrap; }
+</style>
+</head>
+<body>
+<div id="map">{{.Svg}}</div>
+<div id="legend">{{range $i, $e := .Legend}}<button data-class="{{$i}}"><span class="swatch" style="background: #{{$e.Colour}}"></span>{{$e.Label}}</button>{{end}}</div>
+<div id="tooltip" hidden></div>
+<script>
+const regions = {{.Regions}};
+const tooltip = document.getElementById("tooltip");
+const paths = [];
+
+for (const [id, region] of Object.entries(regions)) {
+  const el = document.getElementById(id);
+  if (!el) {
+    continue;
+  }
+  // the custom tooltip replaces the browser's
+  for (const title of el.querySelectorAll("title")) {
+    title.remove();
+  }
+  el.classList.add("region");
+  el.dataset.class = region.class;
+  el.addEventListener("mousemove", (e) => {
+    tooltip.textContent = region.name + ": " + region.tally + (region.value ? " (" + region.value + ")" : "");
+    tooltip.style.left = (e.pageX + 12) + "px";
+    tooltip.style.top = (e.pageY + 12) + "px";
+    tooltip.hidden = false;
+  });
+  el.addEventListener("mouseleave", () => {
+    tooltip.hidden = true;
+  });
+  if (region.url) {
+    el.classList.add("link");
+    el.addEventListener("click", () => {
+      window.location.href = region.url;
+    });
+  }
+  paths.push(el);
+}
+
+// clicking a legend entry shows only that class; clicking it again shows all
+let selected = null;
+for (const button of document.querySelectorAll("#legend button")) {
+  button.addEventListener("click", () => {
+    selected = (selected === button.dataset.class) ? null : button.dataset.class;
+    for (const b of document.querySelectorAll("#legend button")) {
+      b.classList.toggle("active", b.dataset.class === selected);
+    }
+    for (const el of paths) {
+      el.classList.toggle("dimmed", selected !== null && el.dataset.class !== selected);
+    }
+  });
+}
+</script>
+</body>
+</html>
+`))
+
+// a self-contained page with the coloured map, tooltips, and a legend that
+// filters the regions by class
+func htmlPage(mapsvg *svgxml.SVG, scale *Scale, data map[string]float64, values map[string]float64, rates bool, urlTemplate, outfile string) ([]byte, error) {
+	svgOut, err := mapsvg.GetXml()
+	if err != nil {
+		return nil, err
+	}
+	// the XML declaration isn't allowed in HTML
+	if s.HasPrefix(string(svgOut), "<?xml") {
+		if end := bytes.Index(svgOut, []byte("?>")); end >= 0 {
+			svgOut = bytes.TrimSpace(svgOut[end+2:])
+		}
+	}
+
+	regions := make(map[string]htmlRegion)
+	for id, count := range data {
+		e, err := mapsvg.FindPathsById(id, svgxml.FindFirst)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || e[0] == nil {
+			continue
+		}
+
+		name := regionName(e[0], id, count)
+		region := htmlRegion{Name: name, Tally: count, Class: scale.class(values[id])}
+		if rates {
+			region.Value = formatRate(values[id])
+		}
+		if len(urlTemplate) > 0 {
+			region.Url = regionUrl(urlTemplate, id, name, count)
+		}
+		regions[id] = region
+	}
+
+	var legend []htmlLegendEntry
+	for i := range scale.mincount {
+		legend = append(legend, htmlLegendEntry{scale.colours[i], scale.label(i)})
+	}
+
+	var page bytes.Buffer
+	err = htmlTemplate.Execute(&page, map[string]any{
+		"Title":   s.TrimSuffix(filepath.Base(outfile), filepath.Ext(outfile)),
+		"Svg":     template.HTML(svgOut),
+		"Legend":  legend,
+		"Regions": regions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Bytes(), nil
+}
+
+// a region's name: its path's title, or its id
+func regionName(element *svgxml.PathDef, id string, count float64) string {
+	// colourSvgData() has added the tally to the title
+	name := s.TrimSpace(s.TrimSuffix(element.Title, "("+formatValue(count)+")"))
+	if len(name) == 0 {
+		name = s.ReplaceAll(id, "_", " ")
+	}
+	return name
+}
+
+// fill in %id%, %name% and %t% (the tally) in a region URL template
+func regionUrl(urlTemplate, id, name string, count float64) string {
+	escape := func(v string) string {
+		return s.ReplaceAll(url.QueryEscape(v), "+", "%20")
+	}
+	return s.NewReplacer(
+		"%id%", escape(id),
+		"%name%", escape(name),
+		"%t%", formatValue(count),
+	).Replace(urlTemplate)
+}
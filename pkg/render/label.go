@@ -0,0 +1,253 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"slices"
+	"strconv"
+	s "strings"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/raster"
+	"github.com/jeff-blank/svgxml"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/font"
+)
+
+// a region's label and where it goes
+type regionLabel struct {
+	id   string
+	text string
+	x, y float64
+}
+
+// label settings for a map, after inheriting from the defaults
+type labelStyle struct {
+	text      string
+	fontFile  string
+	fontSize  float64
+	textStyle string
+	colour    string
+	halo      string
+	haloWidth int
+	minArea   int
+	decimals  int
+}
+
+func labelSettings(defaults config.LegendAnnotateParams, attrs config.MapSet) labelStyle {
+	ls := labelStyle{
+		text:      defaults.Label,
+		fontFile:  defaults.LabelFontFile,
+		fontSize:  defaults.LabelFontSize,
+		textStyle: defaults.LabelTextStyle,
+		colour:    defaults.LabelColour,
+		halo:      defaults.LabelHaloColour,
+		haloWidth: 2,
+		minArea:   defaults.LabelMinArea,
+		decimals:  DecimalPlaces(defaults.AnnotationDecimals, attrs.LegendAnnotate.AnnotationDecimals),
+	}
+	if len(defaults.LabelHaloWidth) > 0 {
+		ls.haloWidth = defaults.LabelHaloWidth[0]
+	}
+
+	la := attrs.LegendAnnotate
+	if len(la.Label) > 0 {
+		ls.text = la.Label
+	}
+	if len(la.LabelFontFile) > 0 {
+		ls.fontFile = la.LabelFontFile
+	}
+	if la.LabelFontSize > 0 {
+		ls.fontSize = la.LabelFontSize
+	}
+	if len(la.LabelTextStyle) > 0 {
+		ls.textStyle = la.LabelTextStyle
+	}
+	if len(la.LabelColour) > 0 {
+		ls.colour = la.LabelColour
+	}
+	if len(la.LabelHaloColour) > 0 {
+		ls.halo = la.LabelHaloColour
+	}
+	if len(la.LabelHaloWidth) > 0 {
+		ls.haloWidth = la.LabelHaloWidth[0]
+	}
+	if la.LabelMinArea > 0 {
+		ls.minArea = la.LabelMinArea
+	}
+
+	// the annotation font will do for raster labels
+	if len(ls.fontFile) == 0 {
+		ls.fontFile = defaults.AnnotationFontFile
+		if len(la.AnnotationFontFile) > 0 {
+			ls.fontFile = la.AnnotationFontFile
+		}
+	}
+	if ls.fontSize <= 0 {
+		ls.fontSize = 10
+	}
+	if len(ls.colour) == 0 {
+		ls.colour = "000000"
+	}
+	if len(ls.halo) == 0 {
+		ls.halo = "ffffff"
+	}
+	ls.colour = s.TrimPrefix(ls.colour, "#")
+	ls.halo = s.TrimPrefix(ls.halo, "#")
+
+	switch ls.text {
+	case "tally":
+		ls.text = "%t%"
+	case "id":
+		ls.text = "%id%"
+	case "name":
+		ls.text = "%name%"
+	case "value":
+		ls.text = "%v%"
+	}
+	return ls
+}
+
+// the labels for a map's coloured regions that are big enough for one. With
+// a geometry, positions are in pixels of the rasterized map; without, they're
+// in the SVG's units.
+func regionLabels(mapsvg *svgxml.SVG, data map[string]float64, values map[string]float64, scale *Scale, ls labelStyle, infile, geometry string) ([]regionLabel, error) {
+	var ids []string
+	for id, value := range values {
+		if _, ok := scale.Colour(value); ok {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	// the map's shapes don't change when it's coloured, so the input file
+	// will do, and it still has any label anchors
+	svgData, err := os.ReadFile(infile)
+	if err != nil {
+		return nil, err
+	}
+	anchors, err := raster.Anchors(svgData, ids, geometry)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []regionLabel
+	for _, id := range ids {
+		anchor, ok := anchors[id]
+		if !ok || anchor.Area < float64(ls.minArea) {
+			continue
+		}
+		e, err := mapsvg.FindPathsById(id, svgxml.FindFirst)
+		if err != nil {
+			return nil, err
+		}
+		name := s.ReplaceAll(id, "_", " ")
+		if len(e) > 0 && e[0] != nil {
+			name = regionName(e[0], id, data[id])
+		}
+		text := s.NewReplacer(
+			"%t%", FormatNumber(data[id], ls.decimals),
+			"%v%", formatRate(values[id]),
+			"%id%", id,
+			"%name%", name,
+		).Replace(ls.text)
+		labels = append(labels, regionLabel{id, text, anchor.X, anchor.Y})
+	}
+	return labels, nil
+}
+
+// add labels to the SVG as text centred on their anchors, with the halo
+// drawn as a stroke behind the text
+func labelSvg(mapsvg *svgxml.SVG, labels []regionLabel, ls labelStyle) {
+	style := fmt.Sprintf("font-size:%.2fpx;fill:#%s;text-anchor:middle", ls.fontSize, ls.colour)
+	if ls.haloWidth > 0 {
+		style += fmt.Sprintf(";stroke:#%s;stroke-width:%dpx;stroke-linejoin:round;paint-order:stroke", ls.halo, ls.haloWidth*2)
+	}
+	if len(ls.textStyle) > 0 {
+		style += ";" + s.Trim(ls.textStyle, ";")
+	}
+
+	for _, label := range labels {
+		x := strconv.FormatFloat(label.x, 'f', 2, 64)
+		// roughly centred vertically
+		y := strconv.FormatFloat(label.y+ls.fontSize*0.35, 'f', 2, 64)
+		mapsvg.Text = append(mapsvg.Text, svgxml.TextDef{
+			Id:    "Label_" + label.id,
+			Style: style,
+			X:     x,
+			Y:     y,
+			TSpan: []svgxml.TSpanDef{{
+				Id:    "LabelSpan_" + label.id,
+				X:     x,
+				Y:     y,
+				Label: label.text,
+			}},
+		})
+	}
+}
+
+// draw labels on a rasterized map; the halo is the text drawn in the halo
+// colour at every offset within its width
+func labelRaster(img *image.RGBA, labels []regionLabel, ls labelStyle) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	if len(ls.fontFile) == 0 {
+		return fmt.Errorf("labels need a label_fontfile (or annotation_fontfile)")
+	}
+	fontdata, err := os.ReadFile(ls.fontFile)
+	if err != nil {
+		return fmt.Errorf("read font file '%s': %v", ls.fontFile, err)
+	}
+	ttf, err := freetype.ParseFont(fontdata)
+	if err != nil {
+		return fmt.Errorf("ParseFont(): %v", err)
+	}
+	face := truetype.NewFace(ttf, &truetype.Options{Size: ls.fontSize, DPI: 72})
+
+	colour, err := parseHexColour(ls.colour)
+	if err != nil {
+		return err
+	}
+	halo, err := parseHexColour(ls.halo)
+	if err != nil {
+		return err
+	}
+
+	fontCtx := freetype.NewContext()
+	fontCtx.SetDPI(72.0)
+	fontCtx.SetFont(ttf)
+	fontCtx.SetFontSize(ls.fontSize)
+	fontCtx.SetClip(img.Bounds())
+	fontCtx.SetDst(img)
+
+	w := ls.haloWidth
+	for _, label := range labels {
+		width := font.MeasureString(face, label.text).Round()
+		x := int(label.x+0.5) - width/2
+		y := int(label.y + ls.fontSize*0.35 + 0.5)
+
+		if w > 0 {
+			fontCtx.SetSrc(image.NewUniform(halo.rgba()))
+			for dy := -w; dy <= w; dy++ {
+				for dx := -w; dx <= w; dx++ {
+					if dx*dx+dy*dy > w*w || (dx == 0 && dy == 0) {
+						continue
+					}
+					if _, err := fontCtx.DrawString(label.text, freetype.Pt(x+dx, y+dy)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		fontCtx.SetSrc(image.NewUniform(colour.rgba()))
+		if _, err := fontCtx.DrawString(label.text, freetype.Pt(x, y)); err != nil {
+			return err
+		}
+	}
+	log.Debugf("labelRaster(): %d labels", len(labels))
+	return nil
+}
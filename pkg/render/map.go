@@ -0,0 +1,245 @@
+// Package render draws maps: it colours the regions of a template SVG by
+// their values, adds a legend, annotations and labels, and writes the result
+// as SVG, PNG or an HTML page. Settings come in the same shape as in
+// mapper's configuration file (see package config).
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jeff-blank/mapper/pkg/config"
+	"github.com/jeff-blank/mapper/pkg/raster"
+	"github.com/jeff-blank/svgxml"
+	log "github.com/sirupsen/logrus"
+)
+
+// Map is one map being drawn. Load its template SVG, Colour it, then finish
+// it with Document, Image, Page or Write; a Map is finished only once.
+type Map struct {
+	// the map's settings (legend, annotation, labels, delta and the rest),
+	// and the legend_annotation_defaults they override
+	Attrs    config.MapSet
+	Defaults config.LegendAnnotateParams
+
+	// how PNGs are made: "imagemagick" (or "") or "builtin", and the path to
+	// ImageMagick's convert (by default, found in $PATH)
+	Rasterizer  string
+	ImageMagick string
+
+	// for HTML pages, the link for each region when the map has no
+	// region_url of its own
+	RegionUrl string
+
+	svg    *svgxml.SVG
+	data   map[string]float64
+	values map[string]float64
+	rates  bool
+	scale  *Scale
+}
+
+// Load reads a map's template SVG, its infile.
+func Load(attrs config.MapSet, defaults config.LegendAnnotateParams) (*Map, error) {
+	attrs.InputFile = filepath.FromSlash(attrs.InputFile)
+	mapsvg, err := svgxml.NewFromFile(attrs.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s || can't create SVG object from %s", err.Error(), attrs.InputFile)
+	}
+	return &Map{Attrs: attrs, Defaults: defaults, svg: mapsvg}, nil
+}
+
+// SVG gives the map's SVG as it is so far.
+func (m *Map) SVG() *svgxml.SVG {
+	return m.svg
+}
+
+// Regions lists the ids of the shapes Colour can fill, in document order:
+// paths with a fill colour in their style.
+func (m *Map) Regions() ([]string, error) {
+	svgData, err := os.ReadFile(m.Attrs.InputFile)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := raster.ShapeIds(svgData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", m.Attrs.InputFile, err)
+	}
+
+	var regions []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		e, err := m.svg.FindPathsById(id, svgxml.FindFirst)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 0 && e[0] != nil && re_fill.MatchString(e[0].Style) {
+			regions = append(regions, id)
+		}
+	}
+	return regions, nil
+}
+
+// Colour fills each region in data (region id -> tally) with its colour on
+// the scale, and adds its tally to its title. Regions are coloured by their
+// rates instead of their tallies if rates isn't nil (see normalize in the
+// configuration). It returns a message for each region that isn't in the
+// SVG, leaving out those in the map's ignore_missing.
+func (m *Map) Colour(data, rates map[string]float64, scale *Scale) ([]string, error) {
+	values := rates
+	if values == nil {
+		values = data
+	}
+	m.data, m.values, m.rates, m.scale = data, values, rates != nil, scale
+	scale.whole = wholeValues(values)
+	scale.decimals = DecimalPlaces(m.Defaults.LegendDecimals, m.Attrs.LegendAnnotate.LegendDecimals)
+	return colourSvgData(m.svg, data, values, scale, m.Attrs)
+}
+
+// Highlight gives regions (those new since a delta map's baseline, say) the
+// fill and/or outline in the map's delta settings, or a red outline if
+// neither is set.
+func (m *Map) Highlight(ids []string) error {
+	return highlightRegions(m.svg, ids, m.Attrs.Delta)
+}
+
+// Document finishes the map as SVG, with its labels, legend and annotations,
+// on a white background.
+func (m *Map) Document() (*svgxml.SVG, error) {
+	labels, ls, err := m.labels("")
+	if err != nil {
+		return nil, err
+	}
+	labelSvg(m.svg, labels, ls)
+	if err := ahHatesLegends(m.svg, m.scale, m.Defaults, m.Attrs); err != nil {
+		return nil, err
+	}
+	log.Debugf("render: default font size=%+v", m.Defaults.AnnotationFontSize)
+	if err := annotate(m.svg, m.Defaults, m.Attrs, m.data); err != nil {
+		return nil, err
+	}
+	m.svg.AddBackground("#ffffff")
+	return m.svg, nil
+}
+
+// Page finishes the map as a self-contained HTML page, with its labels and
+// annotations; the page has its own legend, which can be clicked.
+func (m *Map) Page() ([]byte, error) {
+	labels, ls, err := m.labels("")
+	if err != nil {
+		return nil, err
+	}
+	labelSvg(m.svg, labels, ls)
+	if err := annotate(m.svg, m.Defaults, m.Attrs, m.data); err != nil {
+		return nil, err
+	}
+	m.svg.AddBackground("#ffffff")
+
+	urlTemplate := m.Attrs.RegionUrl
+	if len(urlTemplate) == 0 {
+		urlTemplate = m.RegionUrl
+	}
+	return htmlPage(m.svg, m.scale, m.data, m.values, m.rates, urlTemplate, m.Attrs.OutputFile)
+}
+
+// Image finishes the map as an image the size of its outsize, with its
+// labels, legend (if there's a legend font) and annotations.
+func (m *Map) Image() (*image.RGBA, error) {
+	labels, ls, err := m.labels(m.Attrs.OutputSize)
+	if err != nil {
+		return nil, err
+	}
+
+	svgOut, err := m.svg.GetXml()
+	if err != nil {
+		return nil, err
+	}
+
+	var imgRbga *image.RGBA
+	switch m.Rasterizer {
+	case "", "imagemagick":
+		imgRbga, err = imagemagickRaster(svgOut, m.ImageMagick, m.Attrs.OutputSize)
+	case "builtin":
+		imgRbga, err = raster.Rasterize(svgOut, m.Attrs.OutputSize)
+	default:
+		return nil, fmt.Errorf("unknown rasterizer '%s'", m.Rasterizer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rasterize: %v", err)
+	}
+
+	if err := labelRaster(imgRbga, labels, ls); err != nil {
+		return nil, fmt.Errorf("labels: %v", err)
+	}
+
+	if len(m.Defaults.LegendFontFile) > 0 || len(m.Attrs.LegendAnnotate.LegendFontFile) > 0 {
+		if err := ahHatesLegends(imgRbga, m.scale, m.Defaults, m.Attrs); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := annotate(imgRbga, m.Defaults, m.Attrs, m.data); err != nil {
+		return nil, err
+	}
+	return imgRbga, nil
+}
+
+// Write finishes the map as "svg", "png" or "html" and writes it to w.
+func (m *Map) Write(w io.Writer, format string) error {
+	var out []byte
+	switch format {
+	case "svg":
+		doc, err := m.Document()
+		if err != nil {
+			return err
+		}
+		if out, err = doc.GetXml(); err != nil {
+			return err
+		}
+	case "html":
+		page, err := m.Page()
+		if err != nil {
+			return err
+		}
+		out = page
+	case "png":
+		img, err := m.Image()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return err
+		}
+		out = buf.Bytes()
+	default:
+		return fmt.Errorf("unknown format '%s'", format)
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// the labels for the coloured regions, if the map has any, placed for an
+// image of the given geometry (or for the SVG itself, if that's empty)
+func (m *Map) labels(geometry string) ([]regionLabel, labelStyle, error) {
+	if m.scale == nil {
+		return nil, labelStyle{}, fmt.Errorf("%s: map not coloured", m.Attrs.InputFile)
+	}
+	ls := labelSettings(m.Defaults, m.Attrs)
+	if len(ls.text) == 0 {
+		return nil, ls, nil
+	}
+	labels, err := regionLabels(m.svg, m.data, m.values, m.scale, ls, m.Attrs.InputFile, geometry)
+	if err != nil {
+		return nil, ls, fmt.Errorf("labels: %v", err)
+	}
+	return labels, ls, nil
+}